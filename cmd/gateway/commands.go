@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/proxy"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runCommand runs a subcommand and returns its exit code. The boolean result
+// is false when args do not name a subcommand and the gateway should start.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "validate":
+		return runValidate(args[1:]), true
+	case "print-config":
+		return runPrintConfig(args[1:]), true
+	default:
+		return 0, false
+	}
+}
+
+// runValidate loads the configuration and reports every problem found
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	flags.Parse(args)
+
+	// The URLs are checked even when loading failed, so that every problem
+	// is reported at once
+	cfg, err := config.Load(*configPath)
+	errs := config.Errors(err)
+	if cfg != nil {
+		errs = append(errs, validateUpstreamURLs(cfg)...)
+		for _, warning := range cfg.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid (%d problems):\n", len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  - %v\n", err)
+		}
+		return 1
+	}
+
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+// validateUpstreamURLs applies the proxy's stricter URL checks to every
+// configured upstream. URLs that Load already rejected are skipped, so that
+// they are not reported twice.
+func validateUpstreamURLs(cfg *config.Config) []error {
+	names := make([]string, 0, len(cfg.Proxy.Upstreams))
+	for name := range cfg.Proxy.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		for _, rawURL := range cfg.Proxy.Upstreams[name].URLs {
+			if parsed, err := url.Parse(rawURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				continue
+			}
+			if err := proxy.ValidateURL(rawURL); err != nil {
+				errs = append(errs, fmt.Errorf("upstream %q: URL %q: %w", name, rawURL, err))
+			}
+		}
+	}
+	return errs
+}
+
+// runPrintConfig prints the effective configuration with secrets redacted
+func runPrintConfig(args []string) int {
+	flags := flag.NewFlagSet("print-config", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		for _, err := range config.Errors(err) {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		return 1
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print configuration: %v\n", err)
+		return 1
+	}
+	encoder.Close()
+
+	return 0
+}
@@ -2,39 +2,68 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"ai-api-gateway/internal/api"
 	"ai-api-gateway/internal/auth"
+	"ai-api-gateway/internal/cache"
 	"ai-api-gateway/internal/config"
 	"ai-api-gateway/internal/metrics"
 	"ai-api-gateway/internal/middleware"
 	"ai-api-gateway/internal/proxy"
 	"ai-api-gateway/internal/ratelimiter"
+	"ai-api-gateway/internal/response"
 	"ai-api-gateway/internal/tracing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	startTime           = time.Now()
-	logger              *config.Logger
+	startTime = time.Now()
+	logger    *config.Logger
+	cfg       *config.Config
+	reloader  *configReloader
+)
+
+// gatewayState holds the components that are rebuilt on every configuration
+// reload. Requests always run against a single, consistent state.
+type gatewayState struct {
 	cfg                 *config.Config
-	redisClient         *redis.Client
 	authMiddleware      *auth.AuthMiddleware
 	rateLimitMiddleware *middleware.RateLimitMiddleware
+	redis               *redis.Client // shared with other states unless the credentials changed
 	router              *proxy.Router
-)
+	cache               *cache.Cache // nil if caching is disabled
+	handler             *gin.Engine
+
+	mu      sync.Mutex
+	active  int           // requests running against the state
+	retired bool          // replaced by a newer state
+	idle    chan struct{} // closed once retired with no requests running
+}
 
 func main() {
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	reloadInterval := flag.Duration("reload-interval", defaultReloadInterval(), "how often to poll the config file for changes (0 disables polling)")
+	flag.Parse()
+
 	// Load configuration
 	var err error
-	cfg, err = config.Load()
+	cfg, err = config.Load(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		os.Exit(1)
@@ -43,9 +72,12 @@ func main() {
 	// Initialize logger
 	logger = config.NewLogger(cfg.Observability.LogLevel)
 	logger.Info("Starting AI API Gateway", map[string]interface{}{
-		"version": "1.0.0",
-		"port":    cfg.Server.Port,
+		"version":   "1.0.0",
+		"port":      cfg.Server.Port,
+		"config":    *configPath,
+		"upstreams": len(cfg.Proxy.Upstreams),
 	})
+	logConfigWarnings(cfg)
 
 	// Initialize metrics
 	if cfg.Observability.MetricsEnabled {
@@ -66,36 +98,27 @@ func main() {
 	}
 
 	// Initialize Redis
-	if err := initRedis(); err != nil {
+	redisClient, err := newRedisClient(cfg)
+	if err != nil {
 		logger.Fatal("Failed to initialize Redis", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
 
-	// Initialize authentication
-	if err := initAuth(); err != nil {
-		logger.Fatal("Failed to initialize authentication", map[string]interface{}{
-			"error": err.Error(),
-		})
-	}
-
-	// Initialize rate limiting
-	if err := initRateLimit(); err != nil {
-		logger.Fatal("Failed to initialize rate limiting", map[string]interface{}{
+	// Initialize authentication, rate limiting and proxy router
+	state, err := buildState(cfg, redisClient)
+	if err != nil {
+		logger.Fatal("Failed to initialize gateway", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
+	reloader = newConfigReloader(*configPath, state)
 
-	// Initialize proxy router
-	router = proxy.NewRouter(&cfg.Proxy)
-
-	// Setup HTTP router
-	httpRouter := setupRouter()
-
-	// Create HTTP server
+	// Create HTTP server. Cleartext HTTP/2 (h2c) is accepted alongside
+	// HTTP/1.1 so gRPC clients can connect without TLS.
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:      httpRouter,
+		Handler:      h2c.NewHandler(reloader, &http2.Server{IdleTimeout: cfg.Server.IdleTimeout}),
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
@@ -113,12 +136,18 @@ func main() {
 		}
 	}()
 
+	// Reload configuration on SIGHUP and when the config file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.Run(hup, *reloadInterval)
+
 	// Wait for interrupt signal for graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	logger.Info("Shutting down server", nil)
+	reloader.Stop()
 
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -130,10 +159,66 @@ func main() {
 		})
 	}
 
+	reloader.Current().close()
+
 	logger.Info("Server exited", nil)
 }
 
-func setupRouter() *gin.Engine {
+// logConfigWarnings logs the problems found while loading a configuration
+// that did not prevent it from loading
+func logConfigWarnings(cfg *config.Config) {
+	for _, warning := range cfg.Warnings {
+		logger.Warn("Configuration warning", map[string]interface{}{
+			"warning": warning,
+		})
+	}
+}
+
+// buildState creates the authentication, rate limiting and proxy components
+// for the given configuration
+func buildState(cfg *config.Config, redisClient *redis.Client) (*gatewayState, error) {
+	authMiddleware, err := initAuth(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize authentication: %w", err)
+	}
+
+	rateLimitMiddleware, err := initRateLimit(cfg, redisClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize rate limiting: %w", err)
+	}
+
+	router, err := proxy.NewRouter(&cfg.Proxy, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize proxy router: %w", err)
+	}
+
+	state := &gatewayState{
+		cfg:                 cfg,
+		authMiddleware:      authMiddleware,
+		rateLimitMiddleware: rateLimitMiddleware,
+		redis:               redisClient,
+		router:              router,
+		idle:                make(chan struct{}),
+	}
+	if cfg.Cache.Enabled {
+		state.cache = cache.New(cfg.Cache, redisClient, logger)
+	}
+	state.handler = setupRouter(state)
+
+	return state, nil
+}
+
+// close releases resources held by the state, such as health checkers
+func (s *gatewayState) close() {
+	s.router.Close()
+	if s.cache != nil {
+		s.cache.Close()
+	}
+}
+
+func setupRouter(state *gatewayState) *gin.Engine {
+	cfg := state.cfg
+
 	// Set Gin mode based on log level
 	if cfg.Observability.LogLevel == "debug" {
 		gin.SetMode(gin.DebugMode)
@@ -143,9 +228,19 @@ func setupRouter() *gin.Engine {
 
 	router := gin.New()
 
+	// Only trusted proxies may set the client IP through forwarding headers
+	if err := router.SetTrustedProxies(cfg.Proxy.TrustedProxies); err != nil {
+		logger.Error("Invalid trusted proxies", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
 	// Recovery middleware
 	router.Use(gin.Recovery())
 
+	// Request IDs, used by every later middleware
+	router.Use(middleware.RequestID())
+
 	// Security headers
 	router.Use(middleware.SecurityHeaders())
 
@@ -157,44 +252,79 @@ func setupRouter() *gin.Engine {
 	// Request logging middleware
 	router.Use(middleware.RequestLogger(logger))
 
+	// Response compression and request decompression
+	if cfg.Compression.Enabled || cfg.Compression.DecompressRequests {
+		router.Use(middleware.Compression(cfg.Compression))
+	}
+
 	// Health endpoints (no auth required)
 	router.GET("/health", healthHandler)
-	router.GET("/ready", readyHandler)
+	router.GET("/ready", readyHandler(state.redis))
 
 	// Metrics endpoint (no auth required)
 	if cfg.Observability.MetricsEnabled {
 		router.GET(cfg.Observability.MetricsPath, metricsHandler)
 	}
 
-	// API v1 routes with auth and rate limiting
-	v1 := router.Group("/v1")
+	// Proxy routes with auth and rate limiting
+	var proxyHandlers []gin.HandlerFunc
 
 	// Apply rate limiting middleware
-	if rateLimitMiddleware != nil {
-		v1.Use(rateLimitMiddleware.Middleware())
+	if state.rateLimitMiddleware != nil {
+		proxyHandlers = append(proxyHandlers, state.rateLimitMiddleware.Middleware())
 	}
 
 	// Apply authentication middleware
-	if authMiddleware != nil {
-		v1.Use(authMiddleware.Middleware())
+	if state.authMiddleware != nil {
+		proxyHandlers = append(proxyHandlers, state.authMiddleware.Middleware())
+	}
+
+	// Serve cached responses after authentication, so cache keys can
+	// include the user, and after choosing the route and upstream subset,
+	// so responses of one subset are not served to requests sent to another
+	if state.cache != nil {
+		proxyHandlers = append(proxyHandlers, state.router.Resolve, state.cache.Middleware())
 	}
 
+	// Admin API, restricted to tokens carrying the admin role
+	adminAPI := api.NewAdminAPI(nil, cfg, state.router, state.cache)
+	admin := router.Group("/admin", state.authMiddleware.Middleware(), middleware.AdminAuth())
 	{
-		v1.Any("/*path", proxyHandler)
+		admin.GET("/upstreams/:name/split", adminAPI.GetUpstreamSplit)
+		admin.PUT("/upstreams/:name/split", adminAPI.UpdateUpstreamSplit)
+		admin.DELETE("/cache", adminAPI.PurgeCache)
+	}
+
+	if state.router.HasRoutes() {
+		// Route table: every path not handled above is matched against it
+		router.NoRoute(append(proxyHandlers, routeHandler(state.router))...)
+	} else {
+		// Legacy scheme: /v1/{service}/{path}
+		v1 := router.Group("/v1", proxyHandlers...)
+		{
+			v1.Any("/*path", proxyHandler(state.router))
+		}
 	}
 
 	return router
 }
 
-func initRedis() error {
+// newRedisClient connects to Redis with the given configuration
+func newRedisClient(cfg *config.Config) (*redis.Client, error) {
 	opt, err := redis.ParseURL(cfg.Redis.URL)
 	if err != nil {
-		return fmt.Errorf("failed to parse Redis URL: %w", err)
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
+	// An explicitly configured password takes precedence over the URL
+	password := opt.Password
+	if cfg.Redis.Password != "" {
+		password = cfg.Redis.Password.Value()
+	}
+
+	redisClient := redis.NewClient(&redis.Options{
 		Addr:               opt.Addr,
-		Password:           opt.Password,
+		Password:           password,
 		DB:                 opt.DB,
 		MaxRetries:         cfg.Redis.MaxRetries,
 		PoolSize:           cfg.Redis.PoolSize,
@@ -212,26 +342,27 @@ func initRedis() error {
 	defer cancel()
 
 	if err := redisClient.Ping(ctx).Err(); err != nil {
-		return fmt.Errorf("failed to connect to Redis: %w", err)
+		redisClient.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
 	logger.Info("Redis connected", map[string]interface{}{
-		"url": cfg.Redis.URL,
+		"url": config.RedactURL(cfg.Redis.URL),
 	})
 
-	return nil
+	return redisClient, nil
 }
 
-func initAuth() error {
+func initAuth(cfg *config.Config) (*auth.AuthMiddleware, error) {
 	var jwtVerifier *auth.JWTVerifier
 	var oidcVerifier *auth.OIDCVerifier
 	var err error
 
 	// Initialize JWT verifier if needed
 	if cfg.Auth.Type == "jwt" || cfg.Auth.Type == "both" {
-		jwtVerifier, err = auth.NewJWTVerifier(cfg.Auth.JWTSecret)
+		jwtVerifier, err = auth.NewJWTVerifier(cfg.Auth.JWTSecret.Value())
 		if err != nil {
-			return fmt.Errorf("failed to create JWT verifier: %w", err)
+			return nil, fmt.Errorf("failed to create JWT verifier: %w", err)
 		}
 	}
 
@@ -240,47 +371,47 @@ func initAuth() error {
 		oidcConfig := auth.OIDCConfig{
 			Issuer:       cfg.Auth.OIDCIssuer,
 			ClientID:     cfg.Auth.OIDCClientID,
-			ClientSecret: cfg.Auth.OIDCClientSecret,
+			ClientSecret: cfg.Auth.OIDCClientSecret.Value(),
 		}
 		oidcVerifier, err = auth.NewOIDCVerifier(context.Background(), oidcConfig)
 		if err != nil {
-			return fmt.Errorf("failed to create OIDC verifier: %w", err)
+			return nil, fmt.Errorf("failed to create OIDC verifier: %w", err)
 		}
 	}
 
-	authMiddleware = auth.NewAuthMiddleware(&cfg.Auth, jwtVerifier, oidcVerifier)
+	authMiddleware := auth.NewAuthMiddleware(&cfg.Auth, jwtVerifier, oidcVerifier)
 	logger.Info("Authentication initialized", map[string]interface{}{
 		"type": cfg.Auth.Type,
 	})
 
-	return nil
+	return authMiddleware, nil
 }
 
-func initRateLimit() error {
+func initRateLimit(cfg *config.Config, redisClient *redis.Client) (*middleware.RateLimitMiddleware, error) {
 	if !cfg.RateLimit.Enabled {
 		logger.Info("Rate limiting disabled", nil)
-		return nil
+		return nil, nil
 	}
 
 	if redisClient == nil {
-		return fmt.Errorf("Redis client not initialized")
+		return nil, fmt.Errorf("Redis client not initialized")
 	}
 
 	// Create rate limiter using factory
 	factory := ratelimiter.NewFactory(redisClient, &cfg.RateLimit)
 	limiter, err := factory.Create()
 	if err != nil {
-		return fmt.Errorf("failed to create rate limiter: %w", err)
+		return nil, fmt.Errorf("failed to create rate limiter: %w", err)
 	}
 
-	rateLimitMiddleware = middleware.NewRateLimitMiddleware(limiter, cfg.RateLimit.Enabled, cfg.RateLimit.Algorithm)
+	rateLimitMiddleware := middleware.NewRateLimitMiddleware(limiter, cfg.RateLimit.Enabled, cfg.RateLimit.Algorithm)
 	logger.Info("Rate limiting initialized", map[string]interface{}{
 		"algorithm":   cfg.RateLimit.Algorithm,
 		"bucket_size": cfg.RateLimit.BucketSize,
 		"refill_rate": cfg.RateLimit.RefillRate,
 	})
 
-	return nil
+	return rateLimitMiddleware, nil
 }
 
 func healthHandler(c *gin.Context) {
@@ -293,53 +424,69 @@ func healthHandler(c *gin.Context) {
 	})
 }
 
-func readyHandler(c *gin.Context) {
-	// Check Redis connection
-	if redisClient != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-		if err := redisClient.Ping(ctx).Err(); err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"status":    "not_ready",
-				"message":   "Redis connection failed",
-				"timestamp": time.Now().UTC().Format(time.RFC3339),
-			})
-			return
+func readyHandler(redisClient *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Check Redis connection
+		if redisClient != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := redisClient.Ping(ctx).Err(); err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{
+					"status":    "not_ready",
+					"message":   "Redis connection failed",
+					"timestamp": time.Now().UTC().Format(time.RFC3339),
+				})
+				return
+			}
 		}
-	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "ready",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
+		c.JSON(http.StatusOK, gin.H{
+			"status":    "ready",
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		})
+	}
 }
 
 func metricsHandler(c *gin.Context) {
 	metrics.Handler(c.Writer, c.Request)
 }
 
-func proxyHandler(c *gin.Context) {
+func proxyHandler(router *proxy.Router) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		proxyRequest(c, router)
+	}
+}
+
+func routeHandler(router *proxy.Router) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer recordRequestMetrics(c)()
+		router.Handle(c)
+	}
+}
+
+func proxyRequest(c *gin.Context, router *proxy.Router) {
 	// Parse service and path from request
 	path := c.Param("path")
 	service, remainingPath, err := proxy.ParseServicePath(path)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":     "Bad Request",
-			"message":   "Invalid path format",
-			"code":      http.StatusBadRequest,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
+		response.Error(c, http.StatusBadRequest, "Invalid path format")
 		return
 	}
 
 	// Record metrics
+	defer recordRequestMetrics(c)()
+
+	// Proxy request to upstream
+	router.Proxy(c, service, remainingPath)
+}
+
+// recordRequestMetrics counts the request and returns a function that records
+// its duration when called
+func recordRequestMetrics(c *gin.Context) func() {
 	metrics.HTTPRequestTotal.WithLabelValues(c.Request.Method, c.Request.URL.Path, fmt.Sprintf("%d", c.Writer.Status())).Inc()
 	start := time.Now()
-	defer func() {
+	return func() {
 		duration := time.Since(start).Seconds()
 		metrics.HTTPRequestDuration.WithLabelValues(c.Request.Method, c.Request.URL.Path, fmt.Sprintf("%d", c.Writer.Status())).Observe(duration)
-	}()
-
-	// Proxy request to upstream
-	router.Proxy(c, service, remainingPath)
+	}
 }
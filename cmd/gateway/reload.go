@@ -0,0 +1,297 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ai-api-gateway/internal/config"
+)
+
+// drainTimeout bounds how long a replaced state is kept for the requests
+// still running against it, such as long streamed responses
+const drainTimeout = 5 * time.Minute
+
+// configReloader serves requests with the current gateway state and swaps in a
+// freshly built state whenever the configuration is reloaded
+type configReloader struct {
+	path    string
+	current atomic.Pointer[gatewayState]
+	mu      sync.Mutex           // serializes reloads
+	files   map[string]fileStamp // watched config and secret files
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// newConfigReloader creates a reloader serving the given initial state
+func newConfigReloader(path string, state *gatewayState) *configReloader {
+	r := &configReloader{
+		path: path,
+		stop: make(chan struct{}),
+	}
+	r.current.Store(state)
+	r.files = r.stat(state.cfg)
+	return r
+}
+
+// fileStamp identifies the version of a watched file
+type fileStamp struct {
+	target  string // the file a symlink resolves to
+	modTime time.Time
+	size    int64
+}
+
+// ServeHTTP dispatches the request to the current gateway state. Requests
+// already in flight keep running against the state they started with.
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	state := r.acquire()
+	defer state.release()
+	state.handler.ServeHTTP(w, req)
+}
+
+// acquire returns the current state, which is not closed until the caller
+// releases it
+func (r *configReloader) acquire() *gatewayState {
+	for {
+		// A state swapped out in the meantime is retired; take the new one
+		if state := r.current.Load(); state.acquire() {
+			return state
+		}
+	}
+}
+
+// Current returns the active gateway state
+func (r *configReloader) Current() *gatewayState {
+	return r.current.Load()
+}
+
+// Run reloads the configuration whenever a signal is received on hup or the
+// config file changes on disk. It blocks until Stop is called.
+func (r *configReloader) Run(hup <-chan os.Signal, interval time.Duration) {
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading configuration", nil)
+			r.Reload()
+		case <-poll:
+			if r.changed() {
+				logger.Info("Config or secret file changed, reloading configuration", map[string]interface{}{
+					"config": r.path,
+				})
+				r.Reload()
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops watching for configuration changes
+func (r *configReloader) Stop() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
+
+// Reload loads and validates the configuration, builds a new gateway state and
+// atomically swaps it in. The previous state is closed once the requests
+// running against it finish. On any error the current state is kept.
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.current.Load()
+	r.files = r.stat(old.cfg)
+
+	newCfg, err := config.Load(r.path)
+	if err != nil {
+		logger.Error("Configuration reload failed, keeping current configuration", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return err
+	}
+	logConfigWarnings(newCfg)
+
+	// Watch secret files the new configuration starts referencing
+	for path, stamp := range r.stat(newCfg) {
+		if _, ok := r.files[path]; !ok {
+			r.files[path] = stamp
+		}
+	}
+
+	keepStaticConfig(old.cfg, newCfg)
+	redisClient := old.redis
+	if redisCredentialsChanged(old.cfg, newCfg) {
+		// Rotated Redis credentials need a new connection pool
+		redisClient, err = newRedisClient(newCfg)
+		if err != nil {
+			logger.Error("Configuration reload failed, keeping current configuration", map[string]interface{}{
+				"error": err.Error(),
+			})
+			return err
+		}
+	}
+
+	state, err := buildState(newCfg, redisClient)
+	if err != nil {
+		if redisClient != old.redis {
+			redisClient.Close()
+		}
+		logger.Error("Configuration reload failed, keeping current configuration", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return err
+	}
+
+	r.current.Store(state)
+	go drain(old, redisClient != old.redis)
+
+	logger.Info("Configuration reloaded", map[string]interface{}{
+		"upstreams": len(newCfg.Proxy.Upstreams),
+	})
+
+	return nil
+}
+
+// drain closes a replaced state once the requests running against it have
+// finished, or after drainTimeout, along with its Redis client if the new
+// state has its own
+func drain(old *gatewayState, closeRedis bool) {
+	select {
+	case <-old.retire():
+	case <-time.After(drainTimeout):
+		logger.Warn("Requests still running against the previous configuration, closing it anyway", nil)
+	}
+
+	old.close()
+	if closeRedis {
+		old.redis.Close()
+	}
+}
+
+// acquire registers a request running against the state. It returns false if
+// the state is retired.
+func (s *gatewayState) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.retired {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// release unregisters a request running against the state
+func (s *gatewayState) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.retired && s.active == 0 {
+		close(s.idle)
+	}
+}
+
+// retire stops new requests from running against the state. The returned
+// channel is closed once no request is running.
+func (s *gatewayState) retire() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retired = true
+	if s.active == 0 {
+		close(s.idle)
+	}
+	return s.idle
+}
+
+// changed reports whether the config file or a secret file was modified since
+// the last load
+func (r *configReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := r.stat(r.current.Load().cfg)
+	if len(files) != len(r.files) {
+		return true
+	}
+	for path, stamp := range files {
+		previous, ok := r.files[path]
+		if !ok || stamp.target != previous.target || !stamp.modTime.Equal(previous.modTime) || stamp.size != previous.size {
+			return true
+		}
+	}
+	return false
+}
+
+// stat returns the stamps of the config file and of the secret files cfg
+// reads. Kubernetes rotates mounted secrets by swapping a symlink, so the
+// file a path resolves to is part of its stamp. Missing files get an empty
+// stamp.
+func (r *configReloader) stat(cfg *config.Config) map[string]fileStamp {
+	paths := cfg.SecretFiles()
+	if r.path != "" {
+		paths = append(paths, r.path)
+	}
+
+	files := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		var stamp fileStamp
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			if info, err := os.Stat(target); err == nil {
+				stamp = fileStamp{target: target, modTime: info.ModTime(), size: info.Size()}
+			}
+		}
+		files[path] = stamp
+	}
+	return files
+}
+
+// keepStaticConfig copies the settings that are only applied at startup from
+// the running configuration, warning when the new configuration changes them.
+// Redis credentials are applied on reload, so that rotated passwords are
+// picked up.
+func keepStaticConfig(running, next *config.Config) {
+	if next.Server != running.Server {
+		logger.Warn("Server settings changed, restart required to apply them", nil)
+		next.Server = running.Server
+	}
+	redis := running.Redis
+	redis.Password, redis.PasswordFile = next.Redis.Password, next.Redis.PasswordFile
+	if next.Redis != redis {
+		logger.Warn("Redis settings changed, restart required to apply them", nil)
+		next.Redis = redis
+	}
+	if next.Observability != running.Observability {
+		logger.Warn("Observability settings changed, restart required to apply them", nil)
+		next.Observability = running.Observability
+	}
+}
+
+// redisCredentialsChanged reports whether the Redis client must be rebuilt
+// for the next configuration
+func redisCredentialsChanged(running, next *config.Config) bool {
+	return next.Redis.Password != running.Redis.Password
+}
+
+// defaultReloadInterval returns the config file polling interval from the
+// CONFIG_RELOAD_INTERVAL environment variable, defaulting to 10 seconds
+func defaultReloadInterval() time.Duration {
+	if value := os.Getenv("CONFIG_RELOAD_INTERVAL"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil {
+			return interval
+		}
+	}
+	return 10 * time.Second
+}
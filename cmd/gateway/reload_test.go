@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ai-api-gateway/internal/config"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeGatewayConfig writes a config file routing /v1/chat to upstreamURL
+func writeGatewayConfig(t *testing.T, path, upstreamURL string) {
+	require.NoError(t, os.WriteFile(path, []byte(`
+auth:
+  type: mock
+rateLimit:
+  enabled: false
+proxy:
+  upstreams:
+    chat:
+      urls: [`+upstreamURL+`]
+`), 0o600))
+}
+
+func TestReloadDrainsPreviousState(t *testing.T) {
+	logger = config.NewLogger("error")
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	v1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Header().Set("X-Backend", "v1")
+	}))
+	t.Cleanup(v1.Close)
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "v2")
+	}))
+	t.Cleanup(v2.Close)
+
+	configPath := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeGatewayConfig(t, configPath, v1.URL)
+	cfg, err := config.Load(configPath)
+	require.NoError(t, err)
+	old, err := buildState(cfg, nil)
+	require.NoError(t, err)
+	r := newConfigReloader(configPath, old)
+	t.Cleanup(func() { r.Current().close() })
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/chat/models", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// A request is running against the old state when it is swapped out
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() { inFlight <- send() }()
+	<-started
+
+	writeGatewayConfig(t, configPath, v2.URL)
+	require.NoError(t, r.Reload())
+	assert.NotSame(t, old, r.Current())
+	assert.Equal(t, "v2", send().Header().Get("X-Backend"))
+
+	// The old state is kept until the request finishes
+	select {
+	case <-old.idle:
+		t.Fatal("previous state released while a request was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	w := <-inFlight
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "v1", w.Header().Get("X-Backend"))
+	select {
+	case <-old.idle:
+	case <-time.After(time.Second):
+		t.Fatal("previous state not released after its requests finished")
+	}
+}
+
+// fakeRedis answers AUTH and PING over the Redis protocol, recording the
+// passwords clients authenticate with
+type fakeRedis struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	passwords []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeRedis{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			f.mu.Lock()
+			f.passwords = append(f.passwords, args[len(args)-1])
+			f.mu.Unlock()
+			fmt.Fprint(conn, "+OK\r\n")
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// lastPassword returns the password of the latest AUTH command
+func (f *fakeRedis) lastPassword() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.passwords) == 0 {
+		return ""
+	}
+	return f.passwords[len(f.passwords)-1]
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestReloadRotatesRedisPassword(t *testing.T) {
+	logger = config.NewLogger("error")
+	server := newFakeRedis(t)
+
+	// Mounted like a Kubernetes secret volume, whose files are symlinks
+	// through a directory that is swapped on rotation
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	for version, password := range map[string]string{"v1": "old-pass", "v2": "new-pass"} {
+		path := filepath.Join(dir, version, "redis-password")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(password), 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	require.NoError(t, os.Symlink("v1", filepath.Join(dir, "data")))
+	passwordPath := filepath.Join(dir, "data", "redis-password")
+	configPath := filepath.Join(dir, "gateway.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+redis:
+  url: redis://`+server.listener.Addr().String()+`
+  passwordFile: `+passwordPath+`
+auth:
+  type: mock
+rateLimit:
+  enabled: false
+proxy:
+  upstreams:
+    chat:
+      urls: [http://chat:8000]
+`), 0o600))
+
+	cfg, err := config.Load(configPath)
+	require.NoError(t, err)
+	oldClient, err := newRedisClient(cfg)
+	require.NoError(t, err)
+	state, err := buildState(cfg, oldClient)
+	require.NoError(t, err)
+	r := newConfigReloader(configPath, state)
+	t.Cleanup(func() {
+		r.Current().close()
+		r.Current().redis.Close()
+	})
+	assert.Equal(t, "old-pass", server.lastPassword())
+
+	// Reloading unchanged credentials keeps the client
+	assert.False(t, r.changed())
+	require.NoError(t, r.Reload())
+	assert.Same(t, oldClient, r.Current().redis)
+
+	// Swapping the symlink is noticed even though the new file has the same
+	// size and modification time
+	require.NoError(t, os.Symlink("v2", filepath.Join(dir, "data.tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "data.tmp"), filepath.Join(dir, "data")))
+	assert.True(t, r.changed())
+	require.NoError(t, r.Reload())
+	assert.False(t, r.changed())
+
+	assert.NotSame(t, oldClient, r.Current().redis)
+	assert.Equal(t, "new-pass", r.Current().cfg.Redis.Password.Value())
+	assert.Equal(t, "new-pass", server.lastPassword())
+	assert.Eventually(t, func() bool {
+		return errors.Is(oldClient.Ping(context.Background()).Err(), redis.ErrClosed)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,11 +1,16 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
+	"ai-api-gateway/internal/cache"
 	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/proxy"
 	"ai-api-gateway/internal/ratelimiter"
+	"ai-api-gateway/internal/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,13 +19,17 @@ import (
 type AdminAPI struct {
 	rateLimitFactory *ratelimiter.Factory
 	config          *config.Config
+	router          *proxy.Router
+	cache           *cache.Cache // nil if caching is disabled
 }
 
 // NewAdminAPI creates a new admin API
-func NewAdminAPI(factory *ratelimiter.Factory, cfg *config.Config) *AdminAPI {
+func NewAdminAPI(factory *ratelimiter.Factory, cfg *config.Config, router *proxy.Router, cache *cache.Cache) *AdminAPI {
 	return &AdminAPI{
 		rateLimitFactory: factory,
 		config:          cfg,
+		router:          router,
+		cache:           cache,
 	}
 }
 
@@ -38,12 +47,7 @@ func (a *AdminAPI) GetRateLimitPolicies(c *gin.Context) {
 // UpdateRateLimitPolicy updates rate limit policy (for future implementation)
 func (a *AdminAPI) UpdateRateLimitPolicy(c *gin.Context) {
 	// TODO: Implement dynamic rate limit policy updates
-	c.JSON(http.StatusNotImplemented, gin.H{
-		"error":     "Not Implemented",
-		"message":   "Dynamic rate limit policy updates not yet implemented",
-		"code":      http.StatusNotImplemented,
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
+	response.Error(c, http.StatusNotImplemented, "Dynamic rate limit policy updates not yet implemented")
 }
 
 // GetStats returns gateway statistics
@@ -56,3 +60,78 @@ func (a *AdminAPI) GetStats(c *gin.Context) {
 	})
 }
 
+// GetUpstreamSplit returns the traffic split of an upstream between its subsets
+func (a *AdminAPI) GetUpstreamSplit(c *gin.Context) {
+	name := c.Param("name")
+	percentages, ok := a.router.Split(name)
+	if !ok {
+		response.Error(c, http.StatusNotFound, fmt.Sprintf("Upstream '%s' not found or has no subsets", name))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"upstream":    name,
+		"percentages": percentages,
+	})
+}
+
+// splitUpdate is the body of a traffic split update
+type splitUpdate struct {
+	Percentages map[string]float64 `json:"percentages" binding:"required"`
+}
+
+// UpdateUpstreamSplit changes the traffic split of an upstream between its
+// subsets. The change lasts until the configuration is reloaded.
+func (a *AdminAPI) UpdateUpstreamSplit(c *gin.Context) {
+	name := c.Param("name")
+
+	var update splitUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		response.Error(c, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := a.router.SetSplit(name, update.Percentages); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, proxy.ErrUpstreamNotFound) {
+			status = http.StatusNotFound
+		}
+		response.Error(c, status, err.Error())
+		return
+	}
+
+	percentages, _ := a.router.Split(name)
+	c.JSON(http.StatusOK, gin.H{
+		"upstream":    name,
+		"percentages": percentages,
+	})
+}
+
+// PurgeCache removes cached responses by key, or by key prefix, from every
+// replica
+func (a *AdminAPI) PurgeCache(c *gin.Context) {
+	if a.cache == nil {
+		response.Error(c, http.StatusNotFound, "Response caching is not enabled")
+		return
+	}
+
+	key, prefix := c.Query("key"), false
+	if key == "" {
+		key, prefix = c.Query("prefix"), true
+	}
+	if key == "" {
+		response.Error(c, http.StatusBadRequest, "A key or prefix query parameter is required")
+		return
+	}
+
+	memory, shared, err := a.cache.Purge(c.Request.Context(), key, prefix)
+	if err != nil {
+		response.Error(c, http.StatusInternalServerError, fmt.Sprintf("Failed to purge cache: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"memory": memory,
+		"redis":  shared,
+	})
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClaimValues returns the string values of a claim, following dots into
+// nested objects. Array claims such as roles yield one value per element.
+func ClaimValues(claims *Claims, name string) []string {
+	if claims == nil {
+		return nil
+	}
+
+	var value interface{}
+	if claims.Raw != nil {
+		var current interface{} = map[string]interface{}(claims.Raw)
+		for _, key := range strings.Split(name, ".") {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			if current, ok = object[key]; !ok {
+				return nil
+			}
+		}
+		value = current
+	} else {
+		// Claims without raw data, e.g. from mock authentication
+		switch name {
+		case "sub":
+			value = claims.Subject
+		case "user_id":
+			value = claims.UserID
+		case "email":
+			value = claims.Email
+		case "roles":
+			return claims.Roles
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
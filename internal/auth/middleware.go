@@ -8,6 +8,7 @@ import (
 
 	"ai-api-gateway/internal/config"
 	"ai-api-gateway/internal/metrics"
+	"ai-api-gateway/internal/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -41,12 +42,7 @@ func (m *AuthMiddleware) Middleware() gin.HandlerFunc {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			metrics.AuthFailures.WithLabelValues("missing_token", m.config.Type).Inc()
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":     "Unauthorized",
-				"message":   "Missing Authorization header",
-				"code":      http.StatusUnauthorized,
-				"timestamp": c.GetString("timestamp"),
-			})
+			response.Error(c, http.StatusUnauthorized, "Missing Authorization header")
 			c.Abort()
 			return
 		}
@@ -76,24 +72,14 @@ func (m *AuthMiddleware) Middleware() gin.HandlerFunc {
 			}
 			err = nil
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":     "Internal Server Error",
-				"message":   "Invalid authentication configuration",
-				"code":      http.StatusInternalServerError,
-				"timestamp": c.GetString("timestamp"),
-			})
+			response.Error(c, http.StatusInternalServerError, "Invalid authentication configuration")
 			c.Abort()
 			return
 		}
 
 		if err != nil {
 			metrics.AuthFailures.WithLabelValues("invalid_token", m.config.Type).Inc()
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":     "Unauthorized",
-				"message":   "Invalid or expired token",
-				"code":      http.StatusUnauthorized,
-				"timestamp": c.GetString("timestamp"),
-			})
+			response.Error(c, http.StatusUnauthorized, "Invalid or expired token")
 			c.Abort()
 			return
 		}
@@ -127,10 +113,15 @@ func (m *AuthMiddleware) verifyOIDC(ctx context.Context, token string) (*Claims,
 	return m.oidcVerifier.Verify(ctx, token)
 }
 
-// shouldSkipAuth checks if authentication should be skipped for a path
+// shouldSkipAuth checks if authentication should be skipped for a path.
+// Skip paths match on segment boundaries, so /health does not exempt a
+// proxied route such as /healthcare.
 func (m *AuthMiddleware) shouldSkipAuth(path string) bool {
 	for _, skipPath := range m.config.SkipAuthPaths {
-		if strings.HasPrefix(path, skipPath) {
+		if !strings.HasPrefix(path, skipPath) {
+			continue
+		}
+		if len(path) == len(skipPath) || strings.HasSuffix(skipPath, "/") || path[len(skipPath)] == '/' {
 			return true
 		}
 	}
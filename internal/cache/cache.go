@@ -0,0 +1,462 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ai-api-gateway/internal/auth"
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// redisTimeout bounds the Redis writes made after a response is served
+const redisTimeout = 5 * time.Second
+
+// strippedHeaders are response headers that are specific to one response and
+// are not cached
+var strippedHeaders = []string{"X-Request-ID", "X-Cache", "Age"}
+
+// revalidatedHeaders are the headers of a 304 response that update a cached
+// entry
+var revalidatedHeaders = []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date"}
+
+// Cache is a shared HTTP response cache. Responses are kept in a memory tier
+// on each replica and, if Redis is enabled, in Redis for every replica.
+type Cache struct {
+	cfg    config.CacheConfig
+	memory *memoryStore
+	redis  *redisStore // nil if Redis is disabled
+	pubsub *redis.PubSub
+	logger *config.Logger
+}
+
+// purgeMessage tells other replicas to purge entries from their memory tier
+type purgeMessage struct {
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix"`
+}
+
+// New creates a cache. Redis is only used if enabled in cfg and client is
+// not nil.
+func New(cfg config.CacheConfig, client *redis.Client, logger *config.Logger) *Cache {
+	ch := &Cache{
+		cfg:    cfg,
+		memory: newMemoryStore(cfg.MaxEntries),
+		logger: logger,
+	}
+
+	if cfg.Redis && client != nil {
+		ch.redis = &redisStore{client: client, prefix: cfg.KeyPrefix}
+		ch.pubsub = client.Subscribe(context.Background(), ch.purgeChannel())
+		go ch.receivePurges(ch.pubsub.Channel())
+	}
+
+	return ch
+}
+
+// Close stops receiving purges from other replicas
+func (ch *Cache) Close() {
+	if ch.pubsub != nil {
+		ch.pubsub.Close()
+	}
+}
+
+// purgeChannel returns the Redis channel purges are published on
+func (ch *Cache) purgeChannel() string {
+	return ch.cfg.KeyPrefix + "purge"
+}
+
+// receivePurges applies purges published by other replicas to the memory tier
+func (ch *Cache) receivePurges(messages <-chan *redis.Message) {
+	for message := range messages {
+		var purge purgeMessage
+		if err := json.Unmarshal([]byte(message.Payload), &purge); err != nil {
+			ch.logger.Warn("Invalid cache purge message", map[string]interface{}{
+				"error": err.Error(),
+			})
+			continue
+		}
+		ch.purgeMemory(purge.Key, purge.Prefix)
+	}
+}
+
+// Purge removes the entry stored under key, or every entry whose key starts
+// with key if prefix is set, from every replica. It returns the number of
+// entries removed from this replica's memory tier and from Redis.
+func (ch *Cache) Purge(ctx context.Context, key string, prefix bool) (memory, shared int, err error) {
+	memory = ch.purgeMemory(key, prefix)
+	if ch.redis == nil {
+		return memory, 0, nil
+	}
+
+	if shared, err = ch.redis.purge(ctx, key, prefix); err != nil {
+		return memory, shared, err
+	}
+	if !prefix {
+		// Variants of the response are stored under longer keys
+		n, err := ch.redis.purge(ctx, key+" vary:", true)
+		shared += n
+		if err != nil {
+			return memory, shared, err
+		}
+	}
+
+	data, _ := json.Marshal(purgeMessage{Key: key, Prefix: prefix})
+	return memory, shared, ch.redis.client.Publish(ctx, ch.purgeChannel(), data).Err()
+}
+
+// purgeMemory removes entries from the memory tier
+func (ch *Cache) purgeMemory(key string, prefix bool) int {
+	removed := ch.memory.purge(key, prefix)
+	if !prefix {
+		removed += ch.memory.purge(key+" vary:", true)
+	}
+	return removed
+}
+
+// Middleware serves cached responses and caches the responses of the
+// handlers that follow it
+func (ch *Cache) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ch.applies(c.Request) {
+			c.Next()
+			return
+		}
+
+		cc := parseCacheControl(c.Request.Header.Values("Cache-Control"))
+		if cc.has("no-store") {
+			metrics.CacheRequests.WithLabelValues("bypass").Inc()
+			c.Next()
+			return
+		}
+
+		key := ch.key(c)
+		entry := ch.lookup(c.Request.Context(), key, c.Request.Header)
+		if entry != nil && entry.fresh(time.Now()) && !cc.has("no-cache") {
+			metrics.CacheRequests.WithLabelValues("hit").Inc()
+			ch.serve(c, entry, "HIT")
+			return
+		}
+
+		w := &cacheWriter{ResponseWriter: c.Writer, limit: ch.cfg.MaxBodySize}
+		if entry != nil && entry.hasValidators() && !isConditional(c.Request) {
+			// Ask the upstream whether the expired entry is still valid
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				c.Request.Header.Set("If-None-Match", etag)
+			}
+			if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+				c.Request.Header.Set("If-Modified-Since", lastModified)
+			}
+			w.revalidating = true
+		}
+
+		c.Header("X-Cache", "MISS")
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.revalidating {
+			c.Request.Header.Del("If-None-Match")
+			c.Request.Header.Del("If-Modified-Since")
+		}
+		if w.notModified {
+			metrics.CacheRequests.WithLabelValues("revalidated").Inc()
+			entry = entry.refresh(w.Header(), time.Now())
+			ch.store(key, entry, c.Request.Header)
+			ch.serve(c, entry, "REVALIDATED")
+			return
+		}
+
+		if entry != nil {
+			metrics.CacheRequests.WithLabelValues("stale").Inc()
+		} else {
+			metrics.CacheRequests.WithLabelValues("miss").Inc()
+		}
+
+		if response := ch.newEntry(c, w); response != nil {
+			ch.store(key, response, c.Request.Header)
+		}
+	}
+}
+
+// applies reports whether the responses to a request may be cached
+func (ch *Cache) applies(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if len(ch.cfg.Paths) == 0 {
+		return true
+	}
+	for _, path := range ch.cfg.Paths {
+		if hasPathPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix checks if path starts with prefix on a segment boundary, so
+// that /models matches /models and /models/1 but not /models-archive
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return path[len(prefix)] == '/'
+}
+
+// key returns the cache key of a request: its path, sorted query, host, the
+// route, upstream and subset chosen by the router, and the request values
+// configured in keyBy
+func (ch *Cache) key(c *gin.Context) string {
+	var b strings.Builder
+	b.WriteString(c.Request.URL.Path)
+
+	if query := c.Request.URL.Query(); len(query) > 0 {
+		// Encode sorts the query by key
+		b.WriteString("?")
+		b.WriteString(query.Encode())
+	}
+
+	b.WriteString(" host=")
+	b.WriteString(c.Request.Host)
+
+	// Requests routed to different upstreams or subsets, such as a canary,
+	// may get different responses
+	for _, part := range []struct{ name, value string }{
+		{"route", c.GetString("route")},
+		{"upstream", c.GetString("upstream")},
+		{"subset", c.GetString("upstream_subset")},
+	} {
+		if part.value != "" {
+			b.WriteString(" ")
+			b.WriteString(part.name)
+			b.WriteString("=")
+			b.WriteString(url.QueryEscape(part.value))
+		}
+	}
+
+	for _, part := range ch.cfg.KeyBy {
+		var values []string
+		switch {
+		case part == "user_id":
+			values = []string{c.GetString("user_id")}
+		case strings.HasPrefix(part, "header:"):
+			values = c.Request.Header.Values(strings.TrimPrefix(part, "header:"))
+		case strings.HasPrefix(part, "claim:"):
+			claims, _ := auth.GetClaimsFromContext(c.Request.Context())
+			values = auth.ClaimValues(claims, strings.TrimPrefix(part, "claim:"))
+		}
+		b.WriteString(" ")
+		b.WriteString(part)
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(strings.Join(values, ",")))
+	}
+
+	return b.String()
+}
+
+// lookup returns the entry cached for a request, or nil. Redis errors are
+// logged and treated as misses.
+func (ch *Cache) lookup(ctx context.Context, key string, header http.Header) *Entry {
+	entry := ch.get(ctx, key)
+	if entry != nil && entry.Status == 0 {
+		// An index: the response varies on request headers
+		entry = ch.get(ctx, key+varyKey(entry.Vary, header))
+	}
+	return entry
+}
+
+// get returns the entry stored under key, reading through to Redis on a
+// memory miss
+func (ch *Cache) get(ctx context.Context, key string) *Entry {
+	if entry := ch.memory.get(key); entry != nil {
+		return entry
+	}
+	if ch.redis == nil {
+		return nil
+	}
+
+	entry, err := ch.redis.get(ctx, key)
+	if err != nil {
+		ch.logger.Warn("Failed to read from the response cache", map[string]interface{}{
+			"key":   key,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	if entry != nil {
+		ch.memory.set(key, entry, ch.deadline(entry))
+	}
+	return entry
+}
+
+// store caches an entry. Responses that vary on request headers are stored
+// under a variant key, with an index under key. Redis is written in the
+// background.
+func (ch *Cache) store(key string, entry *Entry, header http.Header) {
+	deadline := ch.deadline(entry)
+	if !deadline.After(time.Now()) {
+		return
+	}
+
+	entries := map[string]*Entry{key: entry}
+	if len(entry.Vary) > 0 {
+		entries[key] = &Entry{Stored: entry.Stored, Expires: entry.Expires, Vary: entry.Vary}
+		entries[key+varyKey(entry.Vary, header)] = entry
+	}
+
+	for k, e := range entries {
+		ch.memory.set(k, e, deadline)
+	}
+	if ch.redis == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		for k, e := range entries {
+			if err := ch.redis.set(ctx, k, e, time.Until(deadline)); err != nil {
+				ch.logger.Warn("Failed to write to the response cache", map[string]interface{}{
+					"key":   k,
+					"error": err.Error(),
+				})
+				return
+			}
+		}
+	}()
+}
+
+// deadline returns when an entry is dropped: once it expires, or after
+// retainStale if it can be revalidated
+func (ch *Cache) deadline(entry *Entry) time.Time {
+	if entry.Status == 0 || entry.hasValidators() {
+		return entry.Expires.Add(ch.cfg.RetainStale)
+	}
+	return entry.Expires
+}
+
+// newEntry creates an entry from a response, or returns nil if the response
+// may not be cached
+func (ch *Cache) newEntry(c *gin.Context, w *cacheWriter) *Entry {
+	header := w.Header()
+	if !cacheableStatus[w.Status()] || w.overflow || w.flushed || w.failed || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	if c.Request.Context().Err() != nil {
+		return nil
+	}
+	if length := header.Get("Content-Length"); length != "" && length != strconv.Itoa(w.body.Len()) {
+		// The body was cut short
+		return nil
+	}
+
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	if cc.has("no-store") {
+		return nil
+	}
+	// Responses for one user are only shared if the cache key identifies
+	// the user. Request headers do not, as any client can send them.
+	shared := cc.has("public") || cc.has("s-maxage")
+	perUser := ch.cfg.KeyIdentifiesUser()
+	if cc.has("private") && !perUser {
+		return nil
+	}
+	if c.Request.Header.Get("Authorization") != "" && !shared && !perUser {
+		return nil
+	}
+
+	vary := varyHeaders(header)
+	for _, name := range vary {
+		if name == "*" {
+			return nil
+		}
+	}
+
+	lifetime := freshnessLifetime(header, cc)
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+
+	entry := &Entry{
+		Status: w.Status(),
+		Header: header.Clone(),
+		Body:   append([]byte(nil), w.body.Bytes()...),
+		Stored: time.Now().Add(-age(header)),
+		Vary:   vary,
+	}
+	entry.Expires = entry.Stored.Add(lifetime)
+	for _, name := range strippedHeaders {
+		entry.Header.Del(name)
+	}
+
+	if !entry.fresh(time.Now()) && !entry.hasValidators() {
+		return nil
+	}
+	return entry
+}
+
+// refresh returns a copy of an entry updated by the headers of a 304 response
+func (e *Entry) refresh(header http.Header, now time.Time) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for _, name := range revalidatedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			updated.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	cc := parseCacheControl(updated.Header.Values("Cache-Control"))
+	lifetime := freshnessLifetime(updated.Header, cc)
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+	updated.Stored = now.Add(-age(header))
+	updated.Expires = updated.Stored.Add(lifetime)
+	return &updated
+}
+
+// serve writes a cached response, or 304 Not Modified if the client's copy
+// is current
+func (ch *Cache) serve(c *gin.Context, entry *Entry, result string) {
+	header := c.Writer.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	header.Set("X-Cache", result)
+
+	c.Abort()
+	if notModified(c.Request, entry) {
+		header.Del("Content-Length")
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Status(entry.Status)
+	c.Writer.Write(entry.Body)
+}
+
+// notModified reports whether a conditional request matches a cached entry
+func notModified(req *http.Request, entry *Entry) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, entry.Header.Get("ETag"))
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheableStatus lists the response statuses that may be cached
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheControl holds the directives of Cache-Control headers
+type cacheControl map[string]string
+
+// parseCacheControl parses Cache-Control header values. Directive names are
+// lowercased and quoted values unquoted.
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+// has reports whether a directive is present
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime returns how long a response stays fresh after it was
+// generated, as set by s-maxage, max-age or Expires
+func freshnessLifetime(header http.Header, cc cacheControl) time.Duration {
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			// Invalid dates such as "0" mean already expired
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expires.Sub(date)
+	}
+	return 0
+}
+
+// age returns the value of a response's Age header
+func age(header http.Header) time.Duration {
+	n, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// varyHeaders returns the canonical, sorted names of the request headers a
+// response varies on
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyKey returns the suffix of the key of a response variant: the values
+// of the request headers the response varies on
+func varyKey(names []string, header http.Header) string {
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+strings.Join(header.Values(name), ","))
+	}
+	return " vary:" + strings.Join(parts, "&")
+}
+
+// conditionalHeaders are the request headers that make a request conditional
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// isConditional reports whether a request is conditional
+func isConditional(req *http.Request) bool {
+	for _, name := range conditionalHeaders {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
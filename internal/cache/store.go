@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Entry is a cached response. Entries with Vary set and no status are
+// indexes: they record the request headers a response varies on, and the
+// responses themselves are stored under variant keys.
+type Entry struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`         // when the upstream generated the response
+	Expires time.Time   `json:"expires"`        // end of freshness
+	Vary    []string    `json:"vary,omitempty"` // canonical names of the request headers varied on
+}
+
+// fresh reports whether the entry may be served without revalidation
+func (e *Entry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// hasValidators reports whether the entry can be revalidated with a
+// conditional request
+func (e *Entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// memoryStore is a least recently used cache of entries bounded by count
+type memoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // most recently used first
+	items      map[string]*list.Element
+}
+
+// memoryItem is an entry of the memory store and the time it is dropped
+type memoryItem struct {
+	key      string
+	entry    *Entry
+	deadline time.Time
+}
+
+// newMemoryStore creates a memory store holding up to maxEntries entries
+func newMemoryStore(maxEntries int) *memoryStore {
+	return &memoryStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry stored under key, or nil
+func (m *memoryStore) get(key string) *Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*memoryItem)
+	if time.Now().After(item.deadline) {
+		m.remove(elem)
+		return nil
+	}
+	m.order.MoveToFront(elem)
+	return item.entry
+}
+
+// set stores an entry until deadline, evicting the least recently used
+// entries beyond the maximum
+func (m *memoryStore) set(key string, entry *Entry, deadline time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		item := elem.Value.(*memoryItem)
+		item.entry, item.deadline = entry, deadline
+		m.order.MoveToFront(elem)
+		return
+	}
+
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: entry, deadline: deadline})
+	for m.order.Len() > m.maxEntries {
+		m.remove(m.order.Back())
+	}
+	metrics.CacheEntries.Set(float64(m.order.Len()))
+}
+
+// purge removes the entry stored under key, or every entry whose key starts
+// with key if prefix is set, and returns the number removed
+func (m *memoryStore) purge(key string, prefix bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !prefix {
+		elem, ok := m.items[key]
+		if !ok {
+			return 0
+		}
+		m.remove(elem)
+		return 1
+	}
+
+	removed := 0
+	for k, elem := range m.items {
+		if strings.HasPrefix(k, key) {
+			m.remove(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+// remove drops an element. The caller must hold m.mu.
+func (m *memoryStore) remove(elem *list.Element) {
+	m.order.Remove(elem)
+	delete(m.items, elem.Value.(*memoryItem).key)
+	metrics.CacheEntries.Set(float64(m.order.Len()))
+}
+
+// redisStore keeps entries in Redis, shared by every replica
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// get returns the entry stored under key, or nil
+func (s *redisStore) get(ctx context.Context, key string) (*Entry, error) {
+	data, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// set stores an entry for ttl
+func (s *redisStore) set(ctx context.Context, key string, entry *Entry, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+key, data, ttl).Err()
+}
+
+// purge removes the entry stored under key, or every entry whose key starts
+// with key if prefix is set, and returns the number removed
+func (s *redisStore) purge(ctx context.Context, key string, prefix bool) (int, error) {
+	if !prefix {
+		n, err := s.client.Del(ctx, s.prefix+key).Result()
+		return int(n), err
+	}
+
+	removed := 0
+	iter := s.client.Scan(ctx, 0, escapePattern(s.prefix+key)+"*", 100).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 100 {
+			n, err := s.client.Del(ctx, batch...).Result()
+			if err != nil {
+				return removed, err
+			}
+			removed += int(n)
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return removed, err
+	}
+	if len(batch) > 0 {
+		n, err := s.client.Del(ctx, batch...).Result()
+		if err != nil {
+			return removed, err
+		}
+		removed += int(n)
+	}
+	return removed, nil
+}
+
+// escapePattern escapes the glob characters of a Redis SCAN pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheWriter copies a response into a buffer as it is written to the
+// client, so that it can be cached once complete
+type cacheWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	limit    int
+	overflow bool // the body exceeded limit and is not kept
+	flushed  bool // the response was streamed
+	failed   bool // writing to the client failed
+	// revalidating is set when the cache made the request conditional. A
+	// 304 response then confirms the cached entry, which is served instead.
+	revalidating bool
+	notModified  bool
+}
+
+// WriteHeader records the status of the response, holding back a 304 that
+// confirms a cached entry
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.revalidating && code == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// WriteHeaderNow writes the response headers unless the response is held back
+func (w *cacheWriter) WriteHeaderNow() {
+	if w.notModified {
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Write writes and buffers part of the response body
+func (w *cacheWriter) Write(data []byte) (int, error) {
+	if w.notModified {
+		return len(data), nil
+	}
+	w.capture(data)
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// WriteString writes and buffers part of the response body
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	if w.notModified {
+		return len(s), nil
+	}
+	w.capture([]byte(s))
+	n, err := w.ResponseWriter.WriteString(s)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// Flush sends buffered data to the client. Streamed responses are not cached.
+func (w *cacheWriter) Flush() {
+	w.flushed = true
+	if !w.notModified {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// capture buffers data unless the body grew beyond the limit
+func (w *cacheWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.limit {
+		w.overflow = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// CacheConfig holds the settings of the HTTP response cache. Entries are kept
+// in memory on each replica and, with Redis enabled, shared between replicas.
+type CacheConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MaxEntries  int           `yaml:"maxEntries"`  // entries kept in memory on each replica
+	MaxBodySize int           `yaml:"maxBodySize"` // bytes; larger responses are not cached
+	RetainStale time.Duration `yaml:"retainStale"` // time expired entries with validators are kept for revalidation
+	Redis       bool          `yaml:"redis"`       // share entries between replicas through Redis
+	KeyPrefix   string        `yaml:"keyPrefix"`   // prefix of the Redis keys
+	KeyBy       []string      `yaml:"keyBy"`       // request values added to cache keys: user_id, header:<name> or claim:<name>
+	Paths       []string      `yaml:"paths"`       // path prefixes of cached requests; empty means all
+}
+
+// Validate validates cache settings, reporting every problem found
+func (c *CacheConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	var errs []error
+
+	if c.MaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("maxEntries must be greater than 0"))
+	}
+
+	if c.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("maxBodySize must be greater than 0"))
+	}
+
+	if c.RetainStale < 0 {
+		errs = append(errs, fmt.Errorf("retainStale must not be negative"))
+	}
+
+	if len(c.KeyBy) > 0 && !c.KeyIdentifiesUser() {
+		errs = append(errs, fmt.Errorf("keyBy must include user_id or a claim:<name> entry, as request headers do not identify the user"))
+	}
+
+	for _, part := range c.KeyBy {
+		switch {
+		case part == "user_id":
+		case strings.HasPrefix(part, "header:"):
+			if name := strings.TrimPrefix(part, "header:"); !httpguts.ValidHeaderFieldName(name) {
+				errs = append(errs, fmt.Errorf("invalid header name %q in keyBy", name))
+			}
+		case strings.HasPrefix(part, "claim:") && len(part) > len("claim:"):
+		default:
+			errs = append(errs, fmt.Errorf("invalid keyBy value %q (must be user_id, header:<name> or claim:<name>)", part))
+		}
+	}
+
+	for _, path := range c.Paths {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("path %q must start with /", path))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// KeyIdentifiesUser reports whether cache keys include the authenticated
+// user, so that responses for one user may be cached
+func (c *CacheConfig) KeyIdentifiesUser() bool {
+	for _, part := range c.KeyBy {
+		if part == "user_id" || strings.HasPrefix(part, "claim:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// CompressionConfig holds the settings of response compression and request
+// decompression
+type CompressionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Algorithms   []string `yaml:"algorithms"`   // zstd, br or gzip, preferred first
+	MinSize      int      `yaml:"minSize"`      // bytes; smaller responses are sent uncompressed
+	ContentTypes []string `yaml:"contentTypes"` // compressed media types, e.g. application/json or text/*
+	// DecompressRequests decompresses gzip request bodies before they are
+	// forwarded, for upstreams that do not accept compressed bodies
+	DecompressRequests  bool `yaml:"decompressRequests"`
+	MaxDecompressedSize int  `yaml:"maxDecompressedSize"` // bytes; larger request bodies are rejected
+}
+
+// Validate validates compression settings, reporting every problem found
+func (c *CompressionConfig) Validate() error {
+	var errs []error
+
+	if c.Enabled && len(c.Algorithms) == 0 {
+		errs = append(errs, fmt.Errorf("at least one algorithm is required"))
+	}
+
+	seen := make(map[string]bool, len(c.Algorithms))
+	for _, algorithm := range c.Algorithms {
+		switch algorithm {
+		case "zstd", "br", "gzip":
+		default:
+			errs = append(errs, fmt.Errorf("invalid algorithm %q (must be zstd, br or gzip)", algorithm))
+		}
+		if seen[algorithm] {
+			errs = append(errs, fmt.Errorf("duplicate algorithm %q", algorithm))
+		}
+		seen[algorithm] = true
+	}
+
+	if c.MinSize < 0 {
+		errs = append(errs, fmt.Errorf("minSize must not be negative"))
+	}
+
+	for _, contentType := range c.ContentTypes {
+		if _, _, err := mime.ParseMediaType(strings.Replace(contentType, "/*", "/any", 1)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid content type %q", contentType))
+		}
+	}
+
+	if c.DecompressRequests && c.MaxDecompressedSize <= 0 {
+		errs = append(errs, fmt.Errorf("maxDecompressedSize must be greater than 0"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -1,203 +1,1094 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the gateway
 type Config struct {
-	Server        ServerConfig
-	Redis         RedisConfig
-	Auth          AuthConfig
-	RateLimit     RateLimitConfig
-	Proxy         ProxyConfig
-	Observability ObservabilityConfig
+	Server        ServerConfig        `yaml:"server"`
+	Redis         RedisConfig         `yaml:"redis"`
+	Auth          AuthConfig          `yaml:"auth"`
+	RateLimit     RateLimitConfig     `yaml:"rateLimit"`
+	Proxy         ProxyConfig         `yaml:"proxy"`
+	Cache         CacheConfig         `yaml:"cache"`
+	Compression   CompressionConfig   `yaml:"compression"`
+	Observability ObservabilityConfig `yaml:"observability"`
+
+	// Warnings lists problems found while loading that do not prevent the
+	// gateway from starting, such as ignored environment variables
+	Warnings []string `yaml:"-"`
 }
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
-	Port         int
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	IdleTimeout  time.Duration
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
 }
 
 // RedisConfig holds Redis configuration
 type RedisConfig struct {
-	URL           string
-	MaxRetries    int
-	PoolSize      int
-	MinIdleConns  int
-	DialTimeout   time.Duration
-	ReadTimeout   time.Duration
-	WriteTimeout  time.Duration
-	PoolTimeout   time.Duration
-	IdleTimeout   time.Duration
-	IdleCheckFreq time.Duration
+	URL           string        `yaml:"url"`
+	Password      Secret        `yaml:"password"`     // overrides a password embedded in URL
+	PasswordFile  string        `yaml:"passwordFile"` // file to read Password from
+	MaxRetries    int           `yaml:"maxRetries"`
+	PoolSize      int           `yaml:"poolSize"`
+	MinIdleConns  int           `yaml:"minIdleConns"`
+	DialTimeout   time.Duration `yaml:"dialTimeout"`
+	ReadTimeout   time.Duration `yaml:"readTimeout"`
+	WriteTimeout  time.Duration `yaml:"writeTimeout"`
+	PoolTimeout   time.Duration `yaml:"poolTimeout"`
+	IdleTimeout   time.Duration `yaml:"idleTimeout"`
+	IdleCheckFreq time.Duration `yaml:"idleCheckFreq"`
 }
 
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	Type             string // "jwt", "oidc", "both", "mock"
-	JWTSecret        string
-	OIDCIssuer       string
-	OIDCClientID     string
-	OIDCClientSecret string
-	SkipAuthPaths    []string
+	Type                 string   `yaml:"type"` // "jwt", "oidc", "both", "mock"
+	JWTSecret            Secret   `yaml:"jwtSecret"`
+	JWTSecretFile        string   `yaml:"jwtSecretFile"` // file to read JWTSecret from
+	OIDCIssuer           string   `yaml:"oidcIssuer"`
+	OIDCClientID         string   `yaml:"oidcClientID"`
+	OIDCClientSecret     Secret   `yaml:"oidcClientSecret"`
+	OIDCClientSecretFile string   `yaml:"oidcClientSecretFile"` // file to read OIDCClientSecret from
+	SkipAuthPaths        []string `yaml:"skipAuthPaths"`
 }
 
 // RateLimitConfig holds rate limiting configuration
 type RateLimitConfig struct {
-	Enabled    bool
-	Algorithm  string // "token_bucket", "leaky_bucket", "sliding_window"
-	BucketSize int
-	RefillRate int // tokens per second
-	WindowSize time.Duration
-	KeyPrefix  string
+	Enabled    bool          `yaml:"enabled"`
+	Algorithm  string        `yaml:"algorithm"` // "token_bucket", "leaky_bucket", "sliding_window"
+	BucketSize int           `yaml:"bucketSize"`
+	RefillRate int           `yaml:"refillRate"` // tokens per second
+	WindowSize time.Duration `yaml:"windowSize"`
+	KeyPrefix  string        `yaml:"keyPrefix"`
 }
 
 // ProxyConfig holds proxy configuration
 type ProxyConfig struct {
-	Upstreams       map[string]UpstreamConfig
-	LoadBalancer    string // "round_robin", "least_connections", "weighted"
-	Timeout         time.Duration
-	MaxIdleConns    int
-	IdleConnTimeout time.Duration
+	Upstreams           map[string]UpstreamConfig `yaml:"upstreams"`
+	Routes              []RouteConfig             `yaml:"routes"`            // matched in order; empty means /v1/{upstream}/...
+	LoadBalancer        string                    `yaml:"loadBalancer"`      // "round_robin", "least_connections", "weighted", "consistent_hash", "p2c_ewma"
+	Timeout             time.Duration             `yaml:"timeout"`           // time to receive a response, or its headers when streamed
+	StreamIdleTimeout   time.Duration             `yaml:"streamIdleTimeout"` // time a streamed response may go without data
+	MaxIdleConns        int                       `yaml:"maxIdleConns"`
+	IdleConnTimeout     time.Duration             `yaml:"idleConnTimeout"`
+	RetryBudget         RetryBudgetConfig         `yaml:"retryBudget"`
+	MaxBufferedBodySize int                       `yaml:"maxBufferedBodySize"` // bytes of request body kept in memory for replay
+	WebSocket           WebSocketConfig           `yaml:"webSocket"`
+	Mirror              MirrorConfig              `yaml:"mirror"`
+	Coalesce            CoalesceConfig            `yaml:"coalesce"`
+	ConsistentHash      ConsistentHashConfig      `yaml:"consistentHash"`
+	HideHeaders         []string                  `yaml:"hideHeaders"`    // upstream response headers never returned to clients
+	TrustedProxies      []string                  `yaml:"trustedProxies"` // IPs or CIDRs of proxies whose forwarding headers are trusted
+}
+
+// ConsistentHashConfig selects the request value the consistent_hash load
+// balancer is keyed on. Requests with the same key go to the same URL for as
+// long as it is available.
+type ConsistentHashConfig struct {
+	Source       string `yaml:"source"`       // header, cookie, user_id, client_ip or body_field
+	Name         string `yaml:"name"`         // header or cookie name, or dot-separated JSON body field
+	VirtualNodes int    `yaml:"virtualNodes"` // ring points per URL and unit of weight
+}
+
+// MirrorConfig bounds the work spent on mirrored requests. Mirrored requests
+// wait in a queue of QueueSize for one of Concurrency workers; requests that
+// do not fit in the queue are not mirrored.
+type MirrorConfig struct {
+	Concurrency int `yaml:"concurrency"`
+	QueueSize   int `yaml:"queueSize"`
+}
+
+// CoalesceConfig controls request coalescing: identical GET and HEAD
+// requests in flight at the same time are sent upstream once and the
+// response is shared between them
+type CoalesceConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	VaryHeaders []string `yaml:"varyHeaders"` // request headers that must match for requests to be collapsed
+	MaxBodySize int      `yaml:"maxBodySize"` // bytes; larger responses are not shared
+}
+
+// WebSocketConfig holds settings for proxied WebSocket sessions
+type WebSocketConfig struct {
+	PingInterval time.Duration `yaml:"pingInterval"` // how often clients are pinged; 0 disables pings
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`  // close sessions without data frames for this long; 0 disables
+}
+
+// RetryBudgetConfig limits retries across all upstreams so they cannot
+// amplify an outage. Over a 10 second window, retries may not exceed Ratio
+// times the number of requests plus MinRetriesPerSecond.
+type RetryBudgetConfig struct {
+	Ratio               float64 `yaml:"ratio"`
+	MinRetriesPerSecond int     `yaml:"minRetriesPerSecond"`
 }
 
 // UpstreamConfig holds configuration for an upstream service
 type UpstreamConfig struct {
-	URLs        []string
-	Weight      int
-	HealthCheck HealthCheckConfig
+	URLs             []string               `yaml:"urls"`
+	Weight           int                    `yaml:"weight"`
+	Protocol         string                 `yaml:"protocol"` // http1 (default), h2c or h2
+	Subsets          []SubsetConfig         `yaml:"subsets"`
+	Split            SplitConfig            `yaml:"split"`
+	HealthCheck      HealthCheckConfig      `yaml:"healthCheck"`
+	Retry            RetryConfig            `yaml:"retry"`
+	Hedge            HedgeConfig            `yaml:"hedge"`
+	Timeouts         TimeoutConfig          `yaml:"timeouts"`
+	Headers          HeaderPolicy           `yaml:"headers"`
+	CircuitBreaker   CircuitBreakerConfig   `yaml:"circuitBreaker"`
+	OutlierDetection OutlierDetectionConfig `yaml:"outlierDetection"`
+}
+
+// OutlierDetectionConfig holds passive health tracking settings. A URL that
+// fails ConsecutiveErrors live requests in a row is ejected from load
+// balancing for BaseEjectionTime times the number of times it was ejected,
+// up to MaxEjectionTime. Setting ConsecutiveErrors to 0 disables detection.
+type OutlierDetectionConfig struct {
+	ConsecutiveErrors  int           `yaml:"consecutiveErrors"`
+	BaseEjectionTime   time.Duration `yaml:"baseEjectionTime"`
+	MaxEjectionTime    time.Duration `yaml:"maxEjectionTime"`
+	MaxEjectionPercent int           `yaml:"maxEjectionPercent"` // share of URLs that may be ejected at once
+}
+
+// CircuitBreakerConfig holds the circuit breaker settings applied to each URL
+// of an upstream. A circuit opens after ConsecutiveFailures failures in a row,
+// or when the error rate over Window reaches ErrorRate with at least
+// MinRequests requests. Setting neither threshold disables the breaker.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutiveFailures"`
+	ErrorRate           float64       `yaml:"errorRate"` // between 0 and 1
+	MinRequests         int           `yaml:"minRequests"`
+	Window              time.Duration `yaml:"window"`
+	OpenDuration        time.Duration `yaml:"openDuration"`     // time before a half-open probe is allowed
+	HalfOpenRequests    int           `yaml:"halfOpenRequests"` // successful probes needed to close the circuit
+}
+
+// Enabled reports whether any circuit breaker threshold is configured
+func (c CircuitBreakerConfig) Enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.ErrorRate > 0
+}
+
+// RetryConfig holds the retry policy of an upstream. Only idempotent requests
+// and requests carrying an Idempotency-Key header are retried.
+type RetryConfig struct {
+	MaxAttempts   int           `yaml:"maxAttempts"`   // attempts including the first; 0 or 1 disables retries
+	RetryOn       []int         `yaml:"retryOn"`       // response status codes to retry
+	PerTryTimeout time.Duration `yaml:"perTryTimeout"` // timeout of each attempt; 0 means only the proxy timeout applies
+	BackoffBase   time.Duration `yaml:"backoffBase"`
+	BackoffMax    time.Duration `yaml:"backoffMax"`
+}
+
+// TimeoutConfig holds the timeouts of requests proxied to an upstream. Unset
+// timeouts do not apply. A route's timeouts override those of its upstream
+// one by one.
+type TimeoutConfig struct {
+	Connect        time.Duration `yaml:"connect"`        // establishing a TCP connection to a URL
+	TLSHandshake   time.Duration `yaml:"tlsHandshake"`   // completing the TLS handshake
+	ResponseHeader time.Duration `yaml:"responseHeader"` // receiving response headers once the request is sent
+	Total          time.Duration `yaml:"total"`          // the whole request, including retries and streamed responses
+}
+
+// Override returns the timeouts with those set in o replacing their
+// counterparts
+func (t TimeoutConfig) Override(o TimeoutConfig) TimeoutConfig {
+	if o.Connect > 0 {
+		t.Connect = o.Connect
+	}
+	if o.TLSHandshake > 0 {
+		t.TLSHandshake = o.TLSHandshake
+	}
+	if o.ResponseHeader > 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.Total > 0 {
+		t.Total = o.Total
+	}
+	return t
+}
+
+// Validate validates timeouts
+func (t TimeoutConfig) Validate() error {
+	if t.Connect < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Total < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// SubsetConfig holds a named group of upstream URLs, such as a stable or a
+// canary version, and the percentage of traffic it receives
+type SubsetConfig struct {
+	Name       string   `yaml:"name"`
+	URLs       []string `yaml:"urls"`
+	Percentage float64  `yaml:"percentage"`
+}
+
+// SplitConfig controls how requests are assigned to upstream subsets
+type SplitConfig struct {
+	Sticky       bool   `yaml:"sticky"`       // assign each authenticated user to the same subset
+	CanarySubset string `yaml:"canarySubset"` // subset selected by "X-Canary: always"; defaults to "canary"
+}
+
+// HedgeConfig holds the hedging policy of an upstream. A request that has not
+// received a response after Delay, or after the observed Percentile latency
+// of the upstream, is duplicated to a second URL and the first response wins.
+// Like retries, only requests that are safe to send twice are hedged.
+type HedgeConfig struct {
+	Delay        time.Duration `yaml:"delay"`        // fixed hedge delay, or the fallback until enough latencies are observed
+	Percentile   float64       `yaml:"percentile"`   // e.g. 95 to hedge after the observed p95 latency
+	BudgetRatio  float64       `yaml:"budgetRatio"`  // share of requests that may be hedged, between 0 and 1
+	MinPerSecond int           `yaml:"minPerSecond"` // hedges always allowed per second, regardless of the ratio
+}
+
+// Enabled reports whether hedging is configured
+func (h HedgeConfig) Enabled() bool {
+	return h.Delay > 0 || h.Percentile > 0
 }
 
 // HealthCheckConfig holds health check configuration
 type HealthCheckConfig struct {
-	Path     string
-	Interval time.Duration
-	Timeout  time.Duration
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
 }
 
 // ObservabilityConfig holds observability configuration
 type ObservabilityConfig struct {
-	LogLevel       string
-	TracingEnabled bool
-	JaegerEndpoint string
-	MetricsEnabled bool
-	MetricsPath    string
+	LogLevel       string `yaml:"logLevel"`
+	TracingEnabled bool   `yaml:"tracingEnabled"`
+	JaegerEndpoint string `yaml:"jaegerEndpoint"`
+	MetricsEnabled bool   `yaml:"metricsEnabled"`
+	MetricsPath    string `yaml:"metricsPath"`
 }
 
-// Load loads configuration from environment variables
-func Load() (*Config, error) {
+// Load loads configuration from an optional config file and environment
+// variables. Built-in defaults are overridden by the file, and environment
+// variables override both.
+//
+// All problems found (unknown or malformed file fields, unparseable
+// environment variables and validation failures) are reported together; use
+// Errors to list them individually. Unless the config file cannot be read or
+// parsed, the configuration is returned along with the error, so tools can
+// check it further.
+func Load(path string) (*Config, error) {
+	cfg := defaultConfig()
+	var errs []error
+
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, err
+			}
+			// Type errors still leave the remaining fields decoded, so keep
+			// going and report everything at once
+			for _, msg := range typeErr.Errors {
+				errs = append(errs, fmt.Errorf("config file %s: %s", path, msg))
+			}
+		}
+		errs = append(errs, resolveSecretFiles(cfg)...)
+	}
+
+	if err := applyEnv(cfg); err != nil {
+		errs = append(errs, Errors(err)...)
+	}
+	applyUpstreamDefaults(cfg)
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, Errors(err)...)
+	}
+
+	if len(errs) > 0 {
+		return cfg, fmt.Errorf("configuration validation failed: %w", errors.Join(errs...))
+	}
+
+	return cfg, nil
+}
+
+// Errors flattens an error returned by Load or Validate into the individual
+// problems it reports
+func Errors(err error) []error {
+	if err == nil {
+		return nil
+	}
+
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		var errs []error
+		for _, inner := range e.Unwrap() {
+			errs = append(errs, Errors(inner)...)
+		}
+		return errs
+	case interface{ Unwrap() error }:
+		if inner := e.Unwrap(); inner != nil {
+			if _, joined := inner.(interface{ Unwrap() []error }); joined {
+				return Errors(inner)
+			}
+		}
+	}
+
+	return []error{err}
+}
+
+// defaultConfig returns the built-in configuration defaults
+func defaultConfig() *Config {
 	cfg := &Config{}
 
 	// Server config
-	port := getEnvInt("SERVER_PORT", 8080)
-	cfg.Server.Port = port
-	cfg.Server.ReadTimeout = getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second)
-	cfg.Server.WriteTimeout = getEnvDuration("SERVER_WRITE_TIMEOUT", 30*time.Second)
-	cfg.Server.IdleTimeout = getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second)
+	cfg.Server.Port = 8080
+	cfg.Server.ReadTimeout = 30 * time.Second
+	cfg.Server.WriteTimeout = 30 * time.Second
+	cfg.Server.IdleTimeout = 120 * time.Second
 
 	// Redis config
-	cfg.Redis.URL = getEnvString("REDIS_URL", "redis://localhost:6379")
-	cfg.Redis.MaxRetries = getEnvInt("REDIS_MAX_RETRIES", 3)
-	cfg.Redis.PoolSize = getEnvInt("REDIS_POOL_SIZE", 10)
-	cfg.Redis.MinIdleConns = getEnvInt("REDIS_MIN_IDLE_CONNS", 5)
-	cfg.Redis.DialTimeout = getEnvDuration("REDIS_DIAL_TIMEOUT", 5*time.Second)
-	cfg.Redis.ReadTimeout = getEnvDuration("REDIS_READ_TIMEOUT", 3*time.Second)
-	cfg.Redis.WriteTimeout = getEnvDuration("REDIS_WRITE_TIMEOUT", 3*time.Second)
-	cfg.Redis.PoolTimeout = getEnvDuration("REDIS_POOL_TIMEOUT", 4*time.Second)
-	cfg.Redis.IdleTimeout = getEnvDuration("REDIS_IDLE_TIMEOUT", 5*time.Minute)
-	cfg.Redis.IdleCheckFreq = getEnvDuration("REDIS_IDLE_CHECK_FREQ", 1*time.Minute)
+	cfg.Redis.URL = "redis://localhost:6379"
+	cfg.Redis.MaxRetries = 3
+	cfg.Redis.PoolSize = 10
+	cfg.Redis.MinIdleConns = 5
+	cfg.Redis.DialTimeout = 5 * time.Second
+	cfg.Redis.ReadTimeout = 3 * time.Second
+	cfg.Redis.WriteTimeout = 3 * time.Second
+	cfg.Redis.PoolTimeout = 4 * time.Second
+	cfg.Redis.IdleTimeout = 5 * time.Minute
+	cfg.Redis.IdleCheckFreq = 1 * time.Minute
 
 	// Auth config
-	cfg.Auth.Type = getEnvString("AUTH_TYPE", "both")
-	cfg.Auth.JWTSecret = getEnvString("JWT_SECRET", "")
-	cfg.Auth.OIDCIssuer = getEnvString("OIDC_ISSUER", "")
-	cfg.Auth.OIDCClientID = getEnvString("OIDC_CLIENT_ID", "")
-	cfg.Auth.OIDCClientSecret = getEnvString("OIDC_CLIENT_SECRET", "")
+	cfg.Auth.Type = "both"
 	cfg.Auth.SkipAuthPaths = []string{"/health", "/ready", "/metrics"}
 
 	// Rate limit config
-	cfg.RateLimit.Enabled = getEnvBool("RATELIMIT_ENABLED", true)
-	cfg.RateLimit.Algorithm = getEnvString("RATELIMIT_ALGORITHM", "token_bucket")
-	cfg.RateLimit.BucketSize = getEnvInt("RATELIMIT_BUCKET_SIZE", 100)
-	cfg.RateLimit.RefillRate = getEnvInt("RATELIMIT_REFILL_RATE", 10)
-	cfg.RateLimit.WindowSize = getEnvDuration("RATELIMIT_WINDOW_SIZE", 60*time.Second)
-	cfg.RateLimit.KeyPrefix = getEnvString("RATELIMIT_KEY_PREFIX", "ratelimit:")
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Algorithm = "token_bucket"
+	cfg.RateLimit.BucketSize = 100
+	cfg.RateLimit.RefillRate = 10
+	cfg.RateLimit.WindowSize = 60 * time.Second
+	cfg.RateLimit.KeyPrefix = "ratelimit:"
 
 	// Proxy config
-	cfg.Proxy.LoadBalancer = getEnvString("PROXY_LOAD_BALANCER", "round_robin")
-	cfg.Proxy.Timeout = getEnvDuration("PROXY_TIMEOUT", 30*time.Second)
-	cfg.Proxy.MaxIdleConns = getEnvInt("PROXY_MAX_IDLE_CONNS", 100)
-	cfg.Proxy.IdleConnTimeout = getEnvDuration("PROXY_IDLE_CONN_TIMEOUT", 90*time.Second)
+	cfg.Proxy.LoadBalancer = "round_robin"
+	cfg.Proxy.Timeout = 30 * time.Second
+	cfg.Proxy.StreamIdleTimeout = 60 * time.Second
+	cfg.Proxy.MaxIdleConns = 100
+	cfg.Proxy.IdleConnTimeout = 90 * time.Second
+	cfg.Proxy.RetryBudget.Ratio = 0.2
+	cfg.Proxy.RetryBudget.MinRetriesPerSecond = 10
+	cfg.Proxy.MaxBufferedBodySize = 1 << 20
+	cfg.Proxy.WebSocket.PingInterval = 30 * time.Second
+	cfg.Proxy.WebSocket.IdleTimeout = 5 * time.Minute
+	cfg.Proxy.Mirror.Concurrency = 10
+	cfg.Proxy.Mirror.QueueSize = 100
+	cfg.Proxy.Coalesce.VaryHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding"}
+	cfg.Proxy.Coalesce.MaxBodySize = 1 << 20
+	cfg.Proxy.ConsistentHash.Source = "client_ip"
+	cfg.Proxy.ConsistentHash.VirtualNodes = 100
+	cfg.Proxy.HideHeaders = []string{"Server", "X-Powered-By"}
+	// Trust forwarding headers from anyone, as before trusted proxies were
+	// configurable, so gateways behind an ingress keep the client's address
+	cfg.Proxy.TrustedProxies = []string{"0.0.0.0/0", "::/0"}
 	cfg.Proxy.Upstreams = make(map[string]UpstreamConfig)
 
+	// Cache config
+	cfg.Cache.MaxEntries = 10000
+	cfg.Cache.MaxBodySize = 1 << 20
+	cfg.Cache.RetainStale = 10 * time.Minute
+	cfg.Cache.Redis = true
+	cfg.Cache.KeyPrefix = "cache:"
+
+	// Compression config
+	cfg.Compression.Algorithms = []string{"zstd", "br", "gzip"}
+	cfg.Compression.MinSize = 1024
+	cfg.Compression.ContentTypes = []string{
+		"application/json", "application/x-ndjson", "application/javascript",
+		"application/xml", "image/svg+xml", "text/*",
+	}
+	cfg.Compression.MaxDecompressedSize = 10 << 20
+
 	// Observability config
-	cfg.Observability.LogLevel = getEnvString("LOG_LEVEL", "info")
-	cfg.Observability.TracingEnabled = getEnvBool("TRACING_ENABLED", false)
-	cfg.Observability.JaegerEndpoint = getEnvString("JAEGER_ENDPOINT", "")
-	cfg.Observability.MetricsEnabled = getEnvBool("METRICS_ENABLED", true)
-	cfg.Observability.MetricsPath = getEnvString("METRICS_PATH", "/metrics")
+	cfg.Observability.LogLevel = "info"
+	cfg.Observability.MetricsEnabled = true
+	cfg.Observability.MetricsPath = "/metrics"
 
-	// Validate configuration
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	return cfg
+}
+
+// applyEnv overrides configuration values with environment variables and
+// returns the variables that could not be parsed
+func applyEnv(cfg *Config) error {
+	env := &envLoader{}
+
+	// Server config
+	cfg.Server.Port = env.getInt("SERVER_PORT", cfg.Server.Port)
+	cfg.Server.ReadTimeout = env.getDuration("SERVER_READ_TIMEOUT", cfg.Server.ReadTimeout)
+	cfg.Server.WriteTimeout = env.getDuration("SERVER_WRITE_TIMEOUT", cfg.Server.WriteTimeout)
+	cfg.Server.IdleTimeout = env.getDuration("SERVER_IDLE_TIMEOUT", cfg.Server.IdleTimeout)
+
+	// Redis config
+	cfg.Redis.URL = env.getString("REDIS_URL", cfg.Redis.URL)
+	cfg.Redis.Password = env.getSecret("REDIS_PASSWORD", cfg.Redis.Password)
+	cfg.Redis.MaxRetries = env.getInt("REDIS_MAX_RETRIES", cfg.Redis.MaxRetries)
+	cfg.Redis.PoolSize = env.getInt("REDIS_POOL_SIZE", cfg.Redis.PoolSize)
+	cfg.Redis.MinIdleConns = env.getInt("REDIS_MIN_IDLE_CONNS", cfg.Redis.MinIdleConns)
+	cfg.Redis.DialTimeout = env.getDuration("REDIS_DIAL_TIMEOUT", cfg.Redis.DialTimeout)
+	cfg.Redis.ReadTimeout = env.getDuration("REDIS_READ_TIMEOUT", cfg.Redis.ReadTimeout)
+	cfg.Redis.WriteTimeout = env.getDuration("REDIS_WRITE_TIMEOUT", cfg.Redis.WriteTimeout)
+	cfg.Redis.PoolTimeout = env.getDuration("REDIS_POOL_TIMEOUT", cfg.Redis.PoolTimeout)
+	cfg.Redis.IdleTimeout = env.getDuration("REDIS_IDLE_TIMEOUT", cfg.Redis.IdleTimeout)
+	cfg.Redis.IdleCheckFreq = env.getDuration("REDIS_IDLE_CHECK_FREQ", cfg.Redis.IdleCheckFreq)
+
+	// Auth config
+	cfg.Auth.Type = env.getString("AUTH_TYPE", cfg.Auth.Type)
+	cfg.Auth.JWTSecret = env.getSecret("JWT_SECRET", cfg.Auth.JWTSecret)
+	cfg.Auth.OIDCIssuer = env.getString("OIDC_ISSUER", cfg.Auth.OIDCIssuer)
+	cfg.Auth.OIDCClientID = env.getString("OIDC_CLIENT_ID", cfg.Auth.OIDCClientID)
+	cfg.Auth.OIDCClientSecret = env.getSecret("OIDC_CLIENT_SECRET", cfg.Auth.OIDCClientSecret)
+
+	// Rate limit config
+	cfg.RateLimit.Enabled = env.getBool("RATELIMIT_ENABLED", cfg.RateLimit.Enabled)
+	cfg.RateLimit.Algorithm = env.getString("RATELIMIT_ALGORITHM", cfg.RateLimit.Algorithm)
+	cfg.RateLimit.BucketSize = env.getInt("RATELIMIT_BUCKET_SIZE", cfg.RateLimit.BucketSize)
+	cfg.RateLimit.RefillRate = env.getInt("RATELIMIT_REFILL_RATE", cfg.RateLimit.RefillRate)
+	cfg.RateLimit.WindowSize = env.getDuration("RATELIMIT_WINDOW_SIZE", cfg.RateLimit.WindowSize)
+	cfg.RateLimit.KeyPrefix = env.getString("RATELIMIT_KEY_PREFIX", cfg.RateLimit.KeyPrefix)
+
+	// Proxy config
+	cfg.Proxy.LoadBalancer = env.getString("PROXY_LOAD_BALANCER", cfg.Proxy.LoadBalancer)
+	cfg.Proxy.Timeout = env.getDuration("PROXY_TIMEOUT", cfg.Proxy.Timeout)
+	cfg.Proxy.StreamIdleTimeout = env.getDuration("PROXY_STREAM_IDLE_TIMEOUT", cfg.Proxy.StreamIdleTimeout)
+	cfg.Proxy.MaxIdleConns = env.getInt("PROXY_MAX_IDLE_CONNS", cfg.Proxy.MaxIdleConns)
+	cfg.Proxy.IdleConnTimeout = env.getDuration("PROXY_IDLE_CONN_TIMEOUT", cfg.Proxy.IdleConnTimeout)
+	cfg.Proxy.RetryBudget.Ratio = env.getFloat("PROXY_RETRY_BUDGET_RATIO", cfg.Proxy.RetryBudget.Ratio)
+	cfg.Proxy.RetryBudget.MinRetriesPerSecond = env.getInt("PROXY_RETRY_BUDGET_MIN_PER_SECOND", cfg.Proxy.RetryBudget.MinRetriesPerSecond)
+	cfg.Proxy.MaxBufferedBodySize = env.getInt("PROXY_MAX_BUFFERED_BODY_SIZE", cfg.Proxy.MaxBufferedBodySize)
+	cfg.Proxy.WebSocket.PingInterval = env.getDuration("PROXY_WEBSOCKET_PING_INTERVAL", cfg.Proxy.WebSocket.PingInterval)
+	cfg.Proxy.WebSocket.IdleTimeout = env.getDuration("PROXY_WEBSOCKET_IDLE_TIMEOUT", cfg.Proxy.WebSocket.IdleTimeout)
+	cfg.Proxy.Mirror.Concurrency = env.getInt("PROXY_MIRROR_CONCURRENCY", cfg.Proxy.Mirror.Concurrency)
+	cfg.Proxy.Mirror.QueueSize = env.getInt("PROXY_MIRROR_QUEUE_SIZE", cfg.Proxy.Mirror.QueueSize)
+	cfg.Proxy.Coalesce.Enabled = env.getBool("PROXY_COALESCE_ENABLED", cfg.Proxy.Coalesce.Enabled)
+	cfg.Proxy.Coalesce.VaryHeaders = env.getStringList("PROXY_COALESCE_VARY_HEADERS", cfg.Proxy.Coalesce.VaryHeaders)
+	cfg.Proxy.Coalesce.MaxBodySize = env.getInt("PROXY_COALESCE_MAX_BODY_SIZE", cfg.Proxy.Coalesce.MaxBodySize)
+	cfg.Proxy.ConsistentHash.Source = env.getString("PROXY_CONSISTENT_HASH_SOURCE", cfg.Proxy.ConsistentHash.Source)
+	cfg.Proxy.ConsistentHash.Name = env.getString("PROXY_CONSISTENT_HASH_NAME", cfg.Proxy.ConsistentHash.Name)
+	cfg.Proxy.HideHeaders = env.getStringList("PROXY_HIDE_HEADERS", cfg.Proxy.HideHeaders)
+	cfg.Proxy.TrustedProxies = env.getStringList("PROXY_TRUSTED_PROXIES", cfg.Proxy.TrustedProxies)
+	applyUpstreamEnv(cfg, env)
+
+	// Cache config
+	cfg.Cache.Enabled = env.getBool("CACHE_ENABLED", cfg.Cache.Enabled)
+	cfg.Cache.MaxEntries = env.getInt("CACHE_MAX_ENTRIES", cfg.Cache.MaxEntries)
+	cfg.Cache.MaxBodySize = env.getInt("CACHE_MAX_BODY_SIZE", cfg.Cache.MaxBodySize)
+	cfg.Cache.RetainStale = env.getDuration("CACHE_RETAIN_STALE", cfg.Cache.RetainStale)
+	cfg.Cache.Redis = env.getBool("CACHE_REDIS", cfg.Cache.Redis)
+	cfg.Cache.KeyPrefix = env.getString("CACHE_KEY_PREFIX", cfg.Cache.KeyPrefix)
+	cfg.Cache.KeyBy = env.getStringList("CACHE_KEY_BY", cfg.Cache.KeyBy)
+	cfg.Cache.Paths = env.getStringList("CACHE_PATHS", cfg.Cache.Paths)
+
+	// Compression config
+	cfg.Compression.Enabled = env.getBool("COMPRESSION_ENABLED", cfg.Compression.Enabled)
+	cfg.Compression.Algorithms = env.getStringList("COMPRESSION_ALGORITHMS", cfg.Compression.Algorithms)
+	cfg.Compression.MinSize = env.getInt("COMPRESSION_MIN_SIZE", cfg.Compression.MinSize)
+	cfg.Compression.ContentTypes = env.getStringList("COMPRESSION_CONTENT_TYPES", cfg.Compression.ContentTypes)
+	cfg.Compression.DecompressRequests = env.getBool("COMPRESSION_DECOMPRESS_REQUESTS", cfg.Compression.DecompressRequests)
+	cfg.Compression.MaxDecompressedSize = env.getInt("COMPRESSION_MAX_DECOMPRESSED_SIZE", cfg.Compression.MaxDecompressedSize)
+
+	// Observability config
+	cfg.Observability.LogLevel = env.getString("LOG_LEVEL", cfg.Observability.LogLevel)
+	cfg.Observability.TracingEnabled = env.getBool("TRACING_ENABLED", cfg.Observability.TracingEnabled)
+	cfg.Observability.JaegerEndpoint = env.getString("JAEGER_ENDPOINT", cfg.Observability.JaegerEndpoint)
+	cfg.Observability.MetricsEnabled = env.getBool("METRICS_ENABLED", cfg.Observability.MetricsEnabled)
+	cfg.Observability.MetricsPath = env.getString("METRICS_PATH", cfg.Observability.MetricsPath)
+
+	return env.err()
+}
+
+// upstreamEnvSuffixes lists the recognized UPSTREAM_<NAME>_<FIELD> suffixes.
+// Longer suffixes come first so that e.g. _HEALTH_PATH is not read as part of
+// the upstream name.
+var upstreamEnvSuffixes = []string{
+	"_OUTLIER_MAX_EJECTION_PERCENT",
+	"_OUTLIER_CONSECUTIVE_ERRORS",
+	"_OUTLIER_BASE_EJECTION_TIME",
+	"_CIRCUIT_CONSECUTIVE_FAILURES",
+	"_CIRCUIT_OPEN_DURATION",
+	"_CIRCUIT_ERROR_RATE",
+	"_TIMEOUT_RESPONSE_HEADER",
+	"_TIMEOUT_TLS_HANDSHAKE",
+	"_HEDGE_BUDGET_RATIO",
+	"_RETRY_PER_TRY_TIMEOUT",
+	"_HEDGE_PERCENTILE",
+	"_RETRY_MAX_ATTEMPTS",
+	"_HEDGE_DELAY",
+	"_TIMEOUT_CONNECT",
+	"_TIMEOUT_TOTAL",
+	"_RETRY_ON",
+	"_HEALTH_INTERVAL",
+	"_HEALTH_TIMEOUT",
+	"_HEALTH_PATH",
+	"_PROTOCOL",
+	"_WEIGHT",
+	"_URLS",
+}
+
+// applyUpstreamEnv reads upstream definitions from UPSTREAM_<NAME>_<FIELD>
+// environment variables. The upstream name is lowercased with underscores
+// replaced by hyphens, so UPSTREAM_CHAT_COMPLETIONS_URLS defines the
+// "chat-completions" upstream. Fields override those from the config file.
+// Variables naming no known field are ignored with a warning, as Kubernetes
+// defines UPSTREAM_*_PORT_* variables for services named upstream-*.
+func applyUpstreamEnv(cfg *Config, env *envLoader) {
+	if cfg.Proxy.Upstreams == nil {
+		cfg.Proxy.Upstreams = make(map[string]UpstreamConfig)
 	}
 
-	return cfg, nil
+	for _, entry := range os.Environ() {
+		key, _, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(key, "UPSTREAM_") {
+			continue
+		}
+
+		known := false
+		for _, suffix := range upstreamEnvSuffixes {
+			if !strings.HasSuffix(key, suffix) {
+				continue
+			}
+
+			envName := strings.TrimSuffix(strings.TrimPrefix(key, "UPSTREAM_"), suffix)
+			if envName == "" {
+				break
+			}
+			known = true
+			name := strings.ReplaceAll(strings.ToLower(envName), "_", "-")
+
+			upstream := cfg.Proxy.Upstreams[name]
+			switch suffix {
+			case "_URLS":
+				upstream.URLs = splitList(os.Getenv(key))
+			case "_WEIGHT":
+				upstream.Weight = env.getInt(key, upstream.Weight)
+			case "_PROTOCOL":
+				upstream.Protocol = env.getString(key, upstream.Protocol)
+			case "_HEALTH_PATH":
+				upstream.HealthCheck.Path = env.getString(key, upstream.HealthCheck.Path)
+			case "_HEALTH_INTERVAL":
+				upstream.HealthCheck.Interval = env.getDuration(key, upstream.HealthCheck.Interval)
+			case "_HEALTH_TIMEOUT":
+				upstream.HealthCheck.Timeout = env.getDuration(key, upstream.HealthCheck.Timeout)
+			case "_RETRY_MAX_ATTEMPTS":
+				upstream.Retry.MaxAttempts = env.getInt(key, upstream.Retry.MaxAttempts)
+			case "_RETRY_ON":
+				upstream.Retry.RetryOn = env.getIntList(key, upstream.Retry.RetryOn)
+			case "_RETRY_PER_TRY_TIMEOUT":
+				upstream.Retry.PerTryTimeout = env.getDuration(key, upstream.Retry.PerTryTimeout)
+			case "_HEDGE_DELAY":
+				upstream.Hedge.Delay = env.getDuration(key, upstream.Hedge.Delay)
+			case "_HEDGE_PERCENTILE":
+				upstream.Hedge.Percentile = env.getFloat(key, upstream.Hedge.Percentile)
+			case "_HEDGE_BUDGET_RATIO":
+				upstream.Hedge.BudgetRatio = env.getFloat(key, upstream.Hedge.BudgetRatio)
+			case "_TIMEOUT_CONNECT":
+				upstream.Timeouts.Connect = env.getDuration(key, upstream.Timeouts.Connect)
+			case "_TIMEOUT_TLS_HANDSHAKE":
+				upstream.Timeouts.TLSHandshake = env.getDuration(key, upstream.Timeouts.TLSHandshake)
+			case "_TIMEOUT_RESPONSE_HEADER":
+				upstream.Timeouts.ResponseHeader = env.getDuration(key, upstream.Timeouts.ResponseHeader)
+			case "_TIMEOUT_TOTAL":
+				upstream.Timeouts.Total = env.getDuration(key, upstream.Timeouts.Total)
+			case "_CIRCUIT_CONSECUTIVE_FAILURES":
+				upstream.CircuitBreaker.ConsecutiveFailures = env.getInt(key, upstream.CircuitBreaker.ConsecutiveFailures)
+			case "_CIRCUIT_ERROR_RATE":
+				upstream.CircuitBreaker.ErrorRate = env.getFloat(key, upstream.CircuitBreaker.ErrorRate)
+			case "_CIRCUIT_OPEN_DURATION":
+				upstream.CircuitBreaker.OpenDuration = env.getDuration(key, upstream.CircuitBreaker.OpenDuration)
+			case "_OUTLIER_CONSECUTIVE_ERRORS":
+				upstream.OutlierDetection.ConsecutiveErrors = env.getInt(key, upstream.OutlierDetection.ConsecutiveErrors)
+			case "_OUTLIER_BASE_EJECTION_TIME":
+				upstream.OutlierDetection.BaseEjectionTime = env.getDuration(key, upstream.OutlierDetection.BaseEjectionTime)
+			case "_OUTLIER_MAX_EJECTION_PERCENT":
+				upstream.OutlierDetection.MaxEjectionPercent = env.getInt(key, upstream.OutlierDetection.MaxEjectionPercent)
+			}
+			cfg.Proxy.Upstreams[name] = upstream
+			break
+		}
+		if !known {
+			cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("%s: unknown upstream setting, ignored", key))
+		}
+	}
+}
+
+// splitList splits a comma-separated list, trimming whitespace and dropping
+// empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-// Validate validates the configuration
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpstreamDefaults fills in health check defaults for upstreams that
+// configure a health check path but omit its interval or timeout, and retry,
+// hedging, circuit breaker and outlier detection defaults for upstreams that
+// enable them. The URLs of subsets are added to the upstream's URLs.
+func applyUpstreamDefaults(cfg *Config) {
+	if cfg.Proxy.Upstreams == nil {
+		cfg.Proxy.Upstreams = make(map[string]UpstreamConfig)
+	}
+
+	for name, upstream := range cfg.Proxy.Upstreams {
+		if upstream.HealthCheck.Path != "" {
+			if upstream.HealthCheck.Interval == 0 {
+				upstream.HealthCheck.Interval = 10 * time.Second
+			}
+			if upstream.HealthCheck.Timeout == 0 {
+				upstream.HealthCheck.Timeout = 2 * time.Second
+			}
+		}
+		if upstream.Retry.MaxAttempts > 1 {
+			if upstream.Retry.RetryOn == nil {
+				upstream.Retry.RetryOn = []int{502, 503, 504}
+			}
+			if upstream.Retry.BackoffBase == 0 {
+				upstream.Retry.BackoffBase = 25 * time.Millisecond
+			}
+			if upstream.Retry.BackoffMax == 0 {
+				upstream.Retry.BackoffMax = 250 * time.Millisecond
+			}
+		}
+		if len(upstream.Subsets) > 0 {
+			// Subset URLs are part of the upstream, so they are health
+			// checked and balanced like any other URL
+			for _, subset := range upstream.Subsets {
+				for _, u := range subset.URLs {
+					if !containsString(upstream.URLs, u) {
+						upstream.URLs = append(upstream.URLs, u)
+					}
+				}
+			}
+			if upstream.Split.CanarySubset == "" {
+				upstream.Split.CanarySubset = "canary"
+			}
+		}
+		if upstream.Hedge.Enabled() {
+			if upstream.Hedge.BudgetRatio == 0 {
+				upstream.Hedge.BudgetRatio = 0.1
+			}
+			if upstream.Hedge.MinPerSecond == 0 {
+				upstream.Hedge.MinPerSecond = 1
+			}
+		}
+		if upstream.CircuitBreaker.Enabled() {
+			if upstream.CircuitBreaker.MinRequests == 0 {
+				upstream.CircuitBreaker.MinRequests = 20
+			}
+			if upstream.CircuitBreaker.Window == 0 {
+				upstream.CircuitBreaker.Window = 10 * time.Second
+			}
+			if upstream.CircuitBreaker.OpenDuration == 0 {
+				upstream.CircuitBreaker.OpenDuration = 30 * time.Second
+			}
+			if upstream.CircuitBreaker.HalfOpenRequests == 0 {
+				upstream.CircuitBreaker.HalfOpenRequests = 1
+			}
+		}
+		if upstream.OutlierDetection.ConsecutiveErrors > 0 {
+			if upstream.OutlierDetection.BaseEjectionTime == 0 {
+				upstream.OutlierDetection.BaseEjectionTime = 30 * time.Second
+			}
+			if upstream.OutlierDetection.MaxEjectionTime == 0 {
+				upstream.OutlierDetection.MaxEjectionTime = 5 * time.Minute
+			}
+			if upstream.OutlierDetection.MaxEjectionPercent == 0 {
+				upstream.OutlierDetection.MaxEjectionPercent = 50
+			}
+		}
+		cfg.Proxy.Upstreams[name] = upstream
+	}
+}
+
+// Validate validates the configuration, reporting every problem found
 func (c *Config) Validate() error {
+	var errs []error
+
 	if c.Server.Port <= 0 || c.Server.Port > 65535 {
-		return fmt.Errorf("invalid server port: %d", c.Server.Port)
+		errs = append(errs, fmt.Errorf("invalid server port: %d", c.Server.Port))
+	}
+
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("server timeouts must not be negative"))
 	}
 
 	if c.Auth.Type != "jwt" && c.Auth.Type != "oidc" && c.Auth.Type != "both" && c.Auth.Type != "mock" {
-		return fmt.Errorf("invalid auth type: %s (must be jwt, oidc, both, or mock)", c.Auth.Type)
+		errs = append(errs, fmt.Errorf("invalid auth type: %s (must be jwt, oidc, both, or mock)", c.Auth.Type))
 	}
 
 	if (c.Auth.Type == "jwt" || c.Auth.Type == "both") && c.Auth.JWTSecret == "" {
-		return fmt.Errorf("JWT_SECRET is required when AUTH_TYPE is jwt or both")
+		errs = append(errs, fmt.Errorf("JWT_SECRET is required when AUTH_TYPE is jwt or both"))
 	}
 
 	if (c.Auth.Type == "oidc" || c.Auth.Type == "both") && c.Auth.OIDCIssuer == "" {
-		return fmt.Errorf("OIDC_ISSUER is required when AUTH_TYPE is oidc or both")
+		errs = append(errs, fmt.Errorf("OIDC_ISSUER is required when AUTH_TYPE is oidc or both"))
 	}
 
 	if c.RateLimit.Algorithm != "token_bucket" && c.RateLimit.Algorithm != "leaky_bucket" && c.RateLimit.Algorithm != "sliding_window" {
-		return fmt.Errorf("invalid rate limit algorithm: %s (must be token_bucket, leaky_bucket, or sliding_window)", c.RateLimit.Algorithm)
+		errs = append(errs, fmt.Errorf("invalid rate limit algorithm: %s (must be token_bucket, leaky_bucket, or sliding_window)", c.RateLimit.Algorithm))
 	}
 
 	if c.RateLimit.BucketSize <= 0 {
-		return fmt.Errorf("rate limit bucket size must be greater than 0")
+		errs = append(errs, fmt.Errorf("rate limit bucket size must be greater than 0"))
 	}
 
 	if c.RateLimit.RefillRate <= 0 {
-		return fmt.Errorf("rate limit refill rate must be greater than 0")
+		errs = append(errs, fmt.Errorf("rate limit refill rate must be greater than 0"))
 	}
 
-	return nil
+	if c.RateLimit.Algorithm == "sliding_window" && c.RateLimit.WindowSize < time.Second {
+		errs = append(errs, fmt.Errorf("rate limit window size must be at least 1s for sliding_window"))
+	}
+
+	for _, name := range c.Proxy.HideHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, fmt.Errorf("invalid hidden header name %q", name))
+		}
+	}
+
+	for _, proxy := range c.Proxy.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("invalid trusted proxy %q: must be an IP address or CIDR", proxy))
+		}
+	}
+
+	switch c.Proxy.LoadBalancer {
+	case "round_robin", "least_connections", "weighted", "p2c_ewma":
+	case "consistent_hash":
+		for _, err := range Errors(c.Proxy.ConsistentHash.Validate()) {
+			errs = append(errs, fmt.Errorf("proxy consistent hash: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid load balancer: %s (must be round_robin, least_connections, weighted, consistent_hash, or p2c_ewma)", c.Proxy.LoadBalancer))
+	}
+
+	if c.Proxy.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("proxy timeout must be greater than 0"))
+	}
+
+	if c.Proxy.StreamIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("proxy stream idle timeout must not be negative"))
+	}
+
+	if c.Proxy.WebSocket.PingInterval < 0 || c.Proxy.WebSocket.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("proxy WebSocket ping interval and idle timeout must not be negative"))
+	}
+
+	if c.Proxy.RetryBudget.Ratio < 0 || c.Proxy.RetryBudget.MinRetriesPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("proxy retry budget ratio and minimum retries must not be negative"))
+	}
+
+	if c.Proxy.MaxBufferedBodySize < 0 {
+		errs = append(errs, fmt.Errorf("proxy max buffered body size must not be negative"))
+	}
+
+	if c.Proxy.Mirror.Concurrency < 0 || c.Proxy.Mirror.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("proxy mirror concurrency and queue size must not be negative"))
+	}
+
+	if c.Proxy.Coalesce.Enabled && c.Proxy.Coalesce.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("proxy coalesce max body size must be greater than 0"))
+	}
+
+	for _, name := range c.Proxy.Coalesce.VaryHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, fmt.Errorf("invalid coalesce vary header name %q", name))
+		}
+	}
+
+	if c.Observability.TracingEnabled && c.Observability.JaegerEndpoint == "" {
+		errs = append(errs, fmt.Errorf("JAEGER_ENDPOINT is required when TRACING_ENABLED is true"))
+	}
+
+	if c.Observability.MetricsEnabled && !strings.HasPrefix(c.Observability.MetricsPath, "/") {
+		errs = append(errs, fmt.Errorf("metrics path must start with /: %s", c.Observability.MetricsPath))
+	}
+
+	for _, err := range Errors(c.Cache.Validate()) {
+		errs = append(errs, fmt.Errorf("cache: %w", err))
+	}
+
+	for _, err := range Errors(c.Compression.Validate()) {
+		errs = append(errs, fmt.Errorf("compression: %w", err))
+	}
+
+	names := make([]string, 0, len(c.Proxy.Upstreams))
+	for name := range c.Proxy.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		upstream := c.Proxy.Upstreams[name]
+		for _, err := range Errors(upstream.Validate()) {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+	}
+
+	for i, route := range c.Proxy.Routes {
+		for _, err := range Errors(route.Validate(c.Proxy.Upstreams)) {
+			errs = append(errs, fmt.Errorf("route %q: %w", route.DisplayName(i), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate validates an upstream configuration, reporting every problem found
+func (u *UpstreamConfig) Validate() error {
+	var errs []error
+
+	if len(u.URLs) == 0 {
+		errs = append(errs, fmt.Errorf("at least one URL is required"))
+	}
+
+	for _, rawURL := range u.URLs {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid URL %q: %w", rawURL, err))
+			continue
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("invalid URL %q: scheme must be http or https", rawURL))
+		}
+		if parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid URL %q: missing host", rawURL))
+		}
+	}
+
+	if u.Weight < 0 {
+		errs = append(errs, fmt.Errorf("weight must not be negative"))
+	}
+
+	switch u.Protocol {
+	case "", "http1":
+	case "h2c", "h2":
+		scheme := "http"
+		if u.Protocol == "h2" {
+			scheme = "https"
+		}
+		for _, rawURL := range u.URLs {
+			if parsed, err := url.Parse(rawURL); err == nil && parsed.Scheme != scheme {
+				errs = append(errs, fmt.Errorf("invalid URL %q: protocol %s requires the %s scheme", rawURL, u.Protocol, scheme))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid protocol %q: must be http1, h2c or h2", u.Protocol))
+	}
+
+	if u.HealthCheck.Path != "" && !strings.HasPrefix(u.HealthCheck.Path, "/") {
+		errs = append(errs, fmt.Errorf("health check path must start with /"))
+	}
+
+	if u.HealthCheck.Interval < 0 || u.HealthCheck.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("health check interval and timeout must not be negative"))
+	}
+
+	for _, err := range Errors(u.Retry.Validate()) {
+		errs = append(errs, fmt.Errorf("retry: %w", err))
+	}
+
+	if err := u.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, Errors(u.Headers.Validate())...)
+
+	if len(u.Subsets) > 0 {
+		total := 0.0
+		names := make(map[string]bool, len(u.Subsets))
+		for i, subset := range u.Subsets {
+			if subset.Name == "" {
+				errs = append(errs, fmt.Errorf("subsets[%d]: name is required", i))
+			} else if names[subset.Name] {
+				errs = append(errs, fmt.Errorf("subsets[%d]: duplicate name %q", i, subset.Name))
+			}
+			names[subset.Name] = true
+			if len(subset.URLs) == 0 {
+				errs = append(errs, fmt.Errorf("subset %q: at least one URL is required", subset.Name))
+			}
+			if subset.Percentage < 0 {
+				errs = append(errs, fmt.Errorf("subset %q: percentage must not be negative", subset.Name))
+			}
+			total += subset.Percentage
+		}
+		if math.Abs(total-100) > 0.001 {
+			errs = append(errs, fmt.Errorf("subset percentages must add up to 100, got %g", total))
+		}
+		if u.Split.CanarySubset != "" && !names[u.Split.CanarySubset] && u.Split.CanarySubset != "canary" {
+			errs = append(errs, fmt.Errorf("split: unknown canary subset %q", u.Split.CanarySubset))
+		}
+	}
+
+	h := u.Hedge
+	if h.Delay < 0 {
+		errs = append(errs, fmt.Errorf("hedge: delay must not be negative"))
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		errs = append(errs, fmt.Errorf("hedge: percentile must be between 0 and 100"))
+	}
+	if h.BudgetRatio < 0 || h.BudgetRatio > 1 {
+		errs = append(errs, fmt.Errorf("hedge: budgetRatio must be between 0 and 1"))
+	}
+	if h.MinPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("hedge: minPerSecond must not be negative"))
+	}
+
+	for _, err := range Errors(u.CircuitBreaker.Validate()) {
+		errs = append(errs, fmt.Errorf("circuit breaker: %w", err))
+	}
+
+	od := u.OutlierDetection
+	if od.ConsecutiveErrors < 0 || od.BaseEjectionTime < 0 || od.MaxEjectionTime < 0 {
+		errs = append(errs, fmt.Errorf("outlier detection: consecutiveErrors and ejection times must not be negative"))
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		errs = append(errs, fmt.Errorf("outlier detection: maxEjectionPercent must be between 0 and 100"))
+	}
+	if od.MaxEjectionTime > 0 && od.MaxEjectionTime < od.BaseEjectionTime {
+		errs = append(errs, fmt.Errorf("outlier detection: maxEjectionTime must not be less than baseEjectionTime"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate validates consistent hashing settings, reporting every problem found
+func (h *ConsistentHashConfig) Validate() error {
+	var errs []error
+
+	switch h.Source {
+	case "header", "cookie", "body_field":
+		if h.Name == "" {
+			errs = append(errs, fmt.Errorf("name is required for source %s", h.Source))
+		}
+	case "user_id", "client_ip":
+	default:
+		errs = append(errs, fmt.Errorf("invalid source %q (must be header, cookie, user_id, client_ip, or body_field)", h.Source))
+	}
+
+	if h.VirtualNodes <= 0 {
+		errs = append(errs, fmt.Errorf("virtualNodes must be greater than 0"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate validates a retry policy, reporting every problem found
+func (r *RetryConfig) Validate() error {
+	var errs []error
+
+	if r.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("max attempts must not be negative"))
+	}
+
+	for _, code := range r.RetryOn {
+		if code < 100 || code > 599 {
+			errs = append(errs, fmt.Errorf("invalid status code %d in retryOn", code))
+		}
+	}
+
+	if r.PerTryTimeout < 0 || r.BackoffBase < 0 || r.BackoffMax < 0 {
+		errs = append(errs, fmt.Errorf("per-try timeout and backoff must not be negative"))
+	}
+
+	if r.BackoffMax > 0 && r.BackoffMax < r.BackoffBase {
+		errs = append(errs, fmt.Errorf("backoffMax must not be less than backoffBase"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate validates circuit breaker settings, reporting every problem found
+func (c *CircuitBreakerConfig) Validate() error {
+	var errs []error
+
+	if c.ConsecutiveFailures < 0 || c.MinRequests < 0 || c.HalfOpenRequests < 0 {
+		errs = append(errs, fmt.Errorf("consecutiveFailures, minRequests and halfOpenRequests must not be negative"))
+	}
+
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		errs = append(errs, fmt.Errorf("errorRate must be between 0 and 1"))
+	}
+
+	if c.Window < 0 || c.OpenDuration < 0 {
+		errs = append(errs, fmt.Errorf("window and openDuration must not be negative"))
+	}
+
+	return errors.Join(errs...)
 }
 
 // Helper functions for environment variables
 
-func getEnvString(key, defaultValue string) string {
+// envLoader reads typed environment variables. Values that cannot be parsed
+// keep their current value and are recorded as errors.
+type envLoader struct {
+	errs []error
+}
+
+func (e *envLoader) getString(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvInt(key string, defaultValue int) int {
+// getSecret reads a secret from key, or from the file named by key_FILE
+func (e *envLoader) getSecret(key string, defaultValue Secret) Secret {
+	value := os.Getenv(key)
+	path := os.Getenv(key + "_FILE")
+
+	switch {
+	case value != "" && path != "":
+		e.errs = append(e.errs, fmt.Errorf("%s and %s_FILE are mutually exclusive", key, key))
+		return defaultValue
+	case path != "":
+		secret, err := readSecretFile(path)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s_FILE: %w", key, err))
+			return defaultValue
+		}
+		return secret
+	case value != "":
+		return Secret(value)
+	}
+	return defaultValue
+}
+
+func (e *envLoader) getInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		intValue, err := strconv.Atoi(value)
 		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, value))
 			return defaultValue
 		}
 		return intValue
@@ -205,10 +1096,50 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
-func getEnvBool(key string, defaultValue bool) bool {
+func (e *envLoader) getFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		floatValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid number %q", key, value))
+			return defaultValue
+		}
+		return floatValue
+	}
+	return defaultValue
+}
+
+// getStringList reads a comma-separated list
+func (e *envLoader) getStringList(key string, defaultValue []string) []string {
+	if value, ok := os.LookupEnv(key); ok {
+		return splitList(value)
+	}
+	return defaultValue
+}
+
+// getIntList reads a comma-separated list of integers
+func (e *envLoader) getIntList(key string, defaultValue []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var values []int
+	for _, item := range splitList(value) {
+		intValue, err := strconv.Atoi(item)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, item))
+			return defaultValue
+		}
+		values = append(values, intValue)
+	}
+	return values
+}
+
+func (e *envLoader) getBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		boolValue, err := strconv.ParseBool(value)
 		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q", key, value))
 			return defaultValue
 		}
 		return boolValue
@@ -216,13 +1147,19 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+func (e *envLoader) getDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		duration, err := time.ParseDuration(value)
 		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid duration %q (expected a value such as 30s or 5m)", key, value))
 			return defaultValue
 		}
 		return duration
 	}
 	return defaultValue
 }
+
+// err returns the parse errors collected so far
+func (e *envLoader) err() error {
+	return errors.Join(e.errs...)
+}
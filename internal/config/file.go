@@ -0,0 +1,46 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadFile reads a YAML or JSON config file on top of the given configuration.
+// JSON files are decoded with the YAML decoder, which accepts JSON documents
+// and lets both formats share the same duration syntax (e.g. "30s"). Unknown
+// fields are rejected so that typos do not silently fall back to defaults.
+func loadFile(path string, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return fmt.Errorf("unsupported config file format: %s (must be .yaml, .yml or .json)", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		// An empty file is a valid (if pointless) configuration
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return err
+		}
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
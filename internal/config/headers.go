@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// HeaderPolicy holds the header rules applied to the requests forwarded to an
+// upstream and to the responses returned to clients
+type HeaderPolicy struct {
+	Request  HeaderRules `yaml:"request"`
+	Response HeaderRules `yaml:"response"`
+}
+
+// IsSet reports whether any header rule is configured
+func (h HeaderPolicy) IsSet() bool {
+	return h.Request.IsSet() || h.Response.IsSet()
+}
+
+// Validate validates the header rules, reporting every problem found
+func (h HeaderPolicy) Validate() error {
+	var errs []error
+	for _, err := range Errors(h.Request.Validate()) {
+		errs = append(errs, fmt.Errorf("request headers: %w", err))
+	}
+	for _, err := range Errors(h.Response.Validate()) {
+		errs = append(errs, fmt.Errorf("response headers: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// HeaderRules modifies headers. Headers are renamed first, then removed, then
+// set, then appended to. Set and appended values may contain the
+// placeholders ${client_ip}, ${request_id} and ${claims.<name>}, with
+// dot-separated names for nested claims.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`    // replace any values of the header
+	Append map[string]string `yaml:"append"` // add a value to the header
+	Remove []string          `yaml:"remove"` // drop headers
+	Rename map[string]string `yaml:"rename"` // old name to new name
+}
+
+// IsSet reports whether any header rule is configured
+func (h HeaderRules) IsSet() bool {
+	return len(h.Set) > 0 || len(h.Append) > 0 || len(h.Remove) > 0 || len(h.Rename) > 0
+}
+
+// Validate validates header rules, reporting every problem found
+func (h HeaderRules) Validate() error {
+	var errs []error
+
+	checkName := func(name string) {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, fmt.Errorf("invalid header name %q", name))
+		}
+	}
+	for _, name := range h.Remove {
+		checkName(name)
+	}
+	for from, to := range h.Rename {
+		checkName(from)
+		checkName(to)
+	}
+	for _, values := range []map[string]string{h.Set, h.Append} {
+		for name, value := range values {
+			checkName(name)
+			if _, err := ParseHeaderTemplate(value); err != nil {
+				errs = append(errs, fmt.Errorf("header %q: %w", name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// TemplatePart is a literal piece of a header value template, or one of its
+// placeholders
+type TemplatePart struct {
+	Literal  string
+	Variable string // client_ip, request_id or claims.<name>; empty for literals
+}
+
+// ParseHeaderTemplate splits a header value into literals and ${...}
+// placeholders
+func ParseHeaderTemplate(value string) ([]TemplatePart, error) {
+	var parts []TemplatePart
+	for value != "" {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			parts = append(parts, TemplatePart{Literal: value})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, TemplatePart{Literal: value[:start]})
+		}
+
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", value)
+		}
+		variable := value[start+2 : start+end]
+		switch {
+		case variable == "client_ip", variable == "request_id":
+		case strings.HasPrefix(variable, "claims.") && len(variable) > len("claims."):
+		default:
+			return nil, fmt.Errorf("unknown placeholder ${%s}", variable)
+		}
+		parts = append(parts, TemplatePart{Variable: variable})
+		value = value[start+end+1:]
+	}
+	return parts, nil
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RouteConfig holds configuration for a route. A request is sent to the
+// upstream of the first route whose match conditions all hold.
+type RouteConfig struct {
+	Name          string        `yaml:"name"`
+	Match         RouteMatch    `yaml:"match"`
+	Upstream      string        `yaml:"upstream"`
+	StripPrefix   bool          `yaml:"stripPrefix"`   // remove match.pathPrefix before forwarding
+	PrefixRewrite string        `yaml:"prefixRewrite"` // replace match.pathPrefix before forwarding
+	RegexRewrite  RegexRewrite  `yaml:"regexRewrite"`  // rewrite the path with regex capture substitution
+	PathOverride  string        `yaml:"pathOverride"`  // forward to this fixed path
+	QueryRewrite  QueryRewrite  `yaml:"queryRewrite"`
+	Mirror        MirrorPolicy  `yaml:"mirror"`
+	Timeouts      TimeoutConfig `yaml:"timeouts"` // override the upstream's timeouts
+	Headers       HeaderPolicy  `yaml:"headers"`  // applied after the upstream's header rules
+}
+
+// MirrorPolicy copies a share of the requests of a route to a shadow
+// upstream. Mirrored requests are sent in the background and their responses
+// are discarded.
+type MirrorPolicy struct {
+	Upstream   string  `yaml:"upstream"`
+	Percentage float64 `yaml:"percentage"` // share of requests mirrored, between 0 and 100
+}
+
+// RegexRewrite rewrites the request path by replacing matches of Pattern
+// with Substitution, which may reference capture groups as $1 or ${name}.
+// Pattern defaults to match.pathRegex.
+type RegexRewrite struct {
+	Pattern      string `yaml:"pattern"`
+	Substitution string `yaml:"substitution"`
+}
+
+// IsSet reports whether a regex rewrite is configured
+func (r RegexRewrite) IsSet() bool {
+	return r.Pattern != "" || r.Substitution != ""
+}
+
+// QueryRewrite modifies query parameters before forwarding. Parameters are
+// renamed first, then removed, then added.
+type QueryRewrite struct {
+	Add    map[string]string `yaml:"add"`    // set parameters, replacing values sent by the client
+	Remove []string          `yaml:"remove"` // drop parameters
+	Rename map[string]string `yaml:"rename"` // old name to new name
+}
+
+// IsSet reports whether any query rewrite is configured
+func (q QueryRewrite) IsSet() bool {
+	return len(q.Add) > 0 || len(q.Remove) > 0 || len(q.Rename) > 0
+}
+
+// RouteMatch holds the conditions a request must meet to match a route.
+// Empty conditions match any request.
+type RouteMatch struct {
+	Host       string       `yaml:"host"`       // exact host or wildcard such as *.example.com
+	Path       string       `yaml:"path"`       // exact path
+	PathPrefix string       `yaml:"pathPrefix"` // path prefix, matched on segment boundaries
+	PathRegex  string       `yaml:"pathRegex"`  // regular expression matched against the path
+	Methods    []string     `yaml:"methods"`
+	Headers    []ValueMatch `yaml:"headers"` // request headers
+	Query      []ValueMatch `yaml:"query"`   // query parameters
+	Claims     []ValueMatch `yaml:"claims"`  // authenticated token claims, dot-separated for nested claims
+}
+
+// ValueMatch matches a named request value such as a header. With neither
+// Value nor Regex set it only requires the value to be present.
+type ValueMatch struct {
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`  // exact value
+	Regex  string `yaml:"regex"`  // regular expression
+	Absent bool   `yaml:"absent"` // require the value to be missing
+}
+
+// Validate validates a value match
+func (v *ValueMatch) Validate() error {
+	var errs []error
+
+	if v.Name == "" {
+		errs = append(errs, fmt.Errorf("name is required"))
+	}
+
+	if v.Value != "" && v.Regex != "" {
+		errs = append(errs, fmt.Errorf("value and regex are mutually exclusive"))
+	}
+
+	if v.Absent && (v.Value != "" || v.Regex != "") {
+		errs = append(errs, fmt.Errorf("absent cannot be combined with value or regex"))
+	}
+
+	if v.Regex != "" {
+		if _, err := regexp.Compile(v.Regex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid regex: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// DisplayName returns the route name, or its position when it has none
+func (r *RouteConfig) DisplayName(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+// Validate validates a route configuration against the declared upstreams,
+// reporting every problem found
+func (r *RouteConfig) Validate(upstreams map[string]UpstreamConfig) error {
+	var errs []error
+
+	if r.Upstream == "" {
+		errs = append(errs, fmt.Errorf("upstream is required"))
+	} else if _, ok := upstreams[r.Upstream]; !ok {
+		errs = append(errs, fmt.Errorf("unknown upstream %q", r.Upstream))
+	}
+
+	pathMatchers := 0
+	for _, value := range []string{r.Match.Path, r.Match.PathPrefix, r.Match.PathRegex} {
+		if value != "" {
+			pathMatchers++
+		}
+	}
+	if pathMatchers > 1 {
+		errs = append(errs, fmt.Errorf("only one of match.path, match.pathPrefix and match.pathRegex may be set"))
+	}
+
+	if r.Match.Path != "" && !strings.HasPrefix(r.Match.Path, "/") {
+		errs = append(errs, fmt.Errorf("match.path must start with /"))
+	}
+
+	if r.Match.PathPrefix != "" && !strings.HasPrefix(r.Match.PathPrefix, "/") {
+		errs = append(errs, fmt.Errorf("match.pathPrefix must start with /"))
+	}
+
+	if r.Match.PathRegex != "" {
+		if _, err := regexp.Compile(r.Match.PathRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid match.pathRegex: %w", err))
+		}
+	}
+
+	valueMatches := []struct {
+		kind    string
+		matches []ValueMatch
+	}{
+		{"headers", r.Match.Headers},
+		{"query", r.Match.Query},
+		{"claims", r.Match.Claims},
+	}
+	for _, group := range valueMatches {
+		for i, match := range group.matches {
+			for _, err := range Errors(match.Validate()) {
+				errs = append(errs, fmt.Errorf("match.%s[%d]: %w", group.kind, i, err))
+			}
+		}
+	}
+
+	for _, method := range r.Match.Methods {
+		if method == "" || strings.ToUpper(method) != method {
+			errs = append(errs, fmt.Errorf("invalid method %q (must be an upper-case HTTP method)", method))
+		}
+	}
+
+	errs = append(errs, r.validateRewrites()...)
+
+	if r.Mirror.Upstream != "" {
+		if _, ok := upstreams[r.Mirror.Upstream]; !ok {
+			errs = append(errs, fmt.Errorf("unknown mirror upstream %q", r.Mirror.Upstream))
+		}
+		if r.Mirror.Upstream == r.Upstream {
+			errs = append(errs, fmt.Errorf("mirror upstream must differ from the route upstream"))
+		}
+	}
+	if r.Mirror.Percentage < 0 || r.Mirror.Percentage > 100 {
+		errs = append(errs, fmt.Errorf("mirror percentage must be between 0 and 100"))
+	}
+
+	if err := r.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, Errors(r.Headers.Validate())...)
+
+	return errors.Join(errs...)
+}
+
+// validateRewrites validates the path and query rewrite rules of a route
+func (r *RouteConfig) validateRewrites() []error {
+	var errs []error
+
+	pathRewrites := 0
+	for _, set := range []bool{r.StripPrefix, r.PrefixRewrite != "", r.RegexRewrite.IsSet(), r.PathOverride != ""} {
+		if set {
+			pathRewrites++
+		}
+	}
+	if pathRewrites > 1 {
+		errs = append(errs, fmt.Errorf("only one of stripPrefix, prefixRewrite, regexRewrite and pathOverride may be set"))
+	}
+
+	if (r.StripPrefix || r.PrefixRewrite != "") && r.Match.PathPrefix == "" {
+		errs = append(errs, fmt.Errorf("stripPrefix and prefixRewrite require match.pathPrefix"))
+	}
+
+	if r.PrefixRewrite != "" && !strings.HasPrefix(r.PrefixRewrite, "/") {
+		errs = append(errs, fmt.Errorf("prefixRewrite must start with /"))
+	}
+
+	if r.PathOverride != "" && !strings.HasPrefix(r.PathOverride, "/") {
+		errs = append(errs, fmt.Errorf("pathOverride must start with /"))
+	}
+
+	if r.RegexRewrite.IsSet() {
+		if r.RegexRewrite.Pattern == "" && r.Match.PathRegex == "" {
+			errs = append(errs, fmt.Errorf("regexRewrite.pattern is required unless match.pathRegex is set"))
+		}
+		if r.RegexRewrite.Pattern != "" {
+			if _, err := regexp.Compile(r.RegexRewrite.Pattern); err != nil {
+				errs = append(errs, fmt.Errorf("invalid regexRewrite.pattern: %w", err))
+			}
+		}
+	}
+
+	for name, value := range r.QueryRewrite.Rename {
+		if name == "" || value == "" {
+			errs = append(errs, fmt.Errorf("queryRewrite.rename: parameter names must not be empty"))
+			break
+		}
+	}
+	for name := range r.QueryRewrite.Add {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("queryRewrite.add: parameter names must not be empty"))
+			break
+		}
+	}
+	for _, name := range r.QueryRewrite.Remove {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("queryRewrite.remove: parameter names must not be empty"))
+			break
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// redactedValue replaces secret values in redacted output
+const redactedValue = "[REDACTED]"
+
+// Secret holds a sensitive configuration value. It is redacted whenever it is
+// formatted, logged or marshaled; use Value to obtain the actual secret.
+type Secret string
+
+// Value returns the secret value
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String returns a redacted representation of the secret
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// GoString returns a redacted representation of the secret for %#v
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+// MarshalJSON marshals the secret in redacted form
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", s.String())), nil
+}
+
+// MarshalYAML marshals the secret in redacted form
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// readSecretFile reads a secret from a file such as a Kubernetes secret
+// volume mount. A single trailing newline is stripped.
+func readSecretFile(path string) (Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	value := strings.TrimSuffix(string(data), "\n")
+	value = strings.TrimSuffix(value, "\r")
+	return Secret(value), nil
+}
+
+// resolveSecretFiles loads secrets referenced by *File fields of the config
+// file. Setting both a secret and its file is reported as an error.
+func resolveSecretFiles(cfg *Config) []error {
+	var errs []error
+
+	resolve := func(name string, secret *Secret, path string) {
+		if path == "" {
+			return
+		}
+		if *secret != "" {
+			errs = append(errs, fmt.Errorf("%s and %sFile are mutually exclusive", name, name))
+			return
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sFile: %w", name, err))
+			return
+		}
+		*secret = value
+	}
+
+	resolve("auth.jwtSecret", &cfg.Auth.JWTSecret, cfg.Auth.JWTSecretFile)
+	resolve("auth.oidcClientSecret", &cfg.Auth.OIDCClientSecret, cfg.Auth.OIDCClientSecretFile)
+	resolve("redis.password", &cfg.Redis.Password, cfg.Redis.PasswordFile)
+
+	return errs
+}
+
+// SecretFiles returns the files secrets are read from, set in the config file
+// or by *_FILE environment variables
+func (c *Config) SecretFiles() []string {
+	var files []string
+	for _, path := range []string{
+		c.Auth.JWTSecretFile,
+		c.Auth.OIDCClientSecretFile,
+		c.Redis.PasswordFile,
+		os.Getenv("JWT_SECRET_FILE"),
+		os.Getenv("OIDC_CLIENT_SECRET_FILE"),
+		os.Getenv("REDIS_PASSWORD_FILE"),
+	} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// Redacted returns a copy of the configuration that is safe to print or log.
+// Secret fields redact themselves; credentials embedded in URLs are removed.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Redis.URL = RedactURL(redacted.Redis.URL)
+	return &redacted
+}
+
+// RedactURL hides the password of a URL with embedded credentials
+func RedactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+	return parsed.Redacted()
+}
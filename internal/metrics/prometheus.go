@@ -45,13 +45,14 @@ var (
 		[]string{"reason", "auth_type"},
 	)
 
-	// UpstreamRequests tracks upstream service requests
+	// UpstreamRequests tracks upstream service requests. Duplicates sent by
+	// request hedging are labelled hedged="true".
 	UpstreamRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "upstream_requests_total",
 			Help: "Total number of upstream service requests",
 		},
-		[]string{"upstream", "status"},
+		[]string{"upstream", "status", "hedged"},
 	)
 
 	// UpstreamRequestDuration tracks upstream request latency
@@ -63,6 +64,161 @@ var (
 		},
 		[]string{"upstream", "status"},
 	)
+
+	// UpstreamSubsetRequests counts requests by the upstream subset they were
+	// assigned to, e.g. stable or canary
+	UpstreamSubsetRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_subset_requests_total",
+			Help: "Total number of requests assigned to each upstream subset",
+		},
+		[]string{"upstream", "subset"},
+	)
+
+	// MirrorRequests counts requests mirrored to shadow upstreams by result:
+	// sent, error or dropped
+	MirrorRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_mirror_requests_total",
+			Help: "Total number of requests mirrored to shadow upstreams",
+		},
+		[]string{"upstream", "result"},
+	)
+
+	// UpstreamGRPCRequests counts gRPC calls proxied to upstreams by their
+	// gRPC status code
+	UpstreamGRPCRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_grpc_requests_total",
+			Help: "Total number of gRPC calls proxied to upstream services",
+		},
+		[]string{"upstream", "grpc_service", "grpc_method", "grpc_code"},
+	)
+
+	// UpstreamGRPCRequestDuration tracks the duration of proxied gRPC calls,
+	// including streamed messages
+	UpstreamGRPCRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_grpc_request_duration_seconds",
+			Help:    "Duration of gRPC calls proxied to upstream services in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"upstream", "grpc_service", "grpc_method", "grpc_code"},
+	)
+
+	// UpstreamTimeToFirstByte tracks the time until the first byte of an
+	// upstream response body is received
+	UpstreamTimeToFirstByte = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_time_to_first_byte_seconds",
+			Help:    "Time from sending an upstream request to receiving the first byte of its response body",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamRetries counts retried upstream requests
+	UpstreamRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_retries_total",
+			Help: "Total number of upstream request retries",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamRetryBudgetExhausted counts retries skipped because the retry
+	// budget was exhausted
+	UpstreamRetryBudgetExhausted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_retry_budget_exhausted_total",
+			Help: "Total number of retries skipped because the retry budget was exhausted",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamCoalescedRequests counts requests served with the response of
+	// an identical request already in flight, instead of being sent upstream
+	UpstreamCoalescedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_coalesced_requests_total",
+			Help: "Total number of requests collapsed into an identical in-flight upstream request",
+		},
+		[]string{"upstream"},
+	)
+
+	// WebSocketSessions counts proxied WebSocket sessions
+	WebSocketSessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "websocket_sessions_total",
+			Help: "Total number of proxied WebSocket sessions",
+		},
+		[]string{"upstream"},
+	)
+
+	// WebSocketSessionsActive tracks open WebSocket sessions
+	WebSocketSessionsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "websocket_sessions_active",
+			Help: "Number of active proxied WebSocket sessions",
+		},
+		[]string{"upstream"},
+	)
+
+	// UpstreamLatencyEWMA exports the latency average used by the p2c_ewma
+	// load balancer for each upstream URL
+	UpstreamLatencyEWMA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_latency_ewma_seconds",
+			Help: "Peak EWMA of upstream response latency per URL in seconds",
+		},
+		[]string{"upstream", "url"},
+	)
+
+	// CacheRequests counts cacheable requests by cache result: hit, miss,
+	// stale (an expired entry was replaced), revalidated (an expired entry
+	// was confirmed by the upstream) or bypass
+	CacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Total number of cacheable requests by cache result",
+		},
+		[]string{"result"},
+	)
+
+	// CacheEntries exports the number of responses cached in memory
+	CacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_memory_entries",
+			Help: "Number of responses cached in memory",
+		},
+	)
+
+	// CircuitBreakerState exports the circuit state of each upstream URL
+	CircuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_circuit_breaker_state",
+			Help: "Circuit breaker state per upstream URL (0 closed, 1 open, 2 half-open)",
+		},
+		[]string{"upstream", "url"},
+	)
+
+	// OutlierEjections counts upstream URLs ejected by outlier detection
+	OutlierEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_outlier_ejections_total",
+			Help: "Total number of upstream URL ejections by outlier detection",
+		},
+		[]string{"upstream", "url"},
+	)
+
+	// OutlierEjectedHosts tracks the number of currently ejected URLs
+	OutlierEjectedHosts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_outlier_ejected_hosts",
+			Help: "Number of upstream URLs currently ejected by outlier detection",
+		},
+		[]string{"upstream"},
+	)
 )
 
 // Initialize registers all metrics
@@ -73,6 +229,22 @@ func Initialize() {
 	prometheus.MustRegister(AuthFailures)
 	prometheus.MustRegister(UpstreamRequests)
 	prometheus.MustRegister(UpstreamRequestDuration)
+	prometheus.MustRegister(UpstreamSubsetRequests)
+	prometheus.MustRegister(MirrorRequests)
+	prometheus.MustRegister(UpstreamGRPCRequests)
+	prometheus.MustRegister(UpstreamGRPCRequestDuration)
+	prometheus.MustRegister(UpstreamTimeToFirstByte)
+	prometheus.MustRegister(UpstreamRetries)
+	prometheus.MustRegister(UpstreamRetryBudgetExhausted)
+	prometheus.MustRegister(UpstreamCoalescedRequests)
+	prometheus.MustRegister(WebSocketSessions)
+	prometheus.MustRegister(WebSocketSessionsActive)
+	prometheus.MustRegister(UpstreamLatencyEWMA)
+	prometheus.MustRegister(CacheRequests)
+	prometheus.MustRegister(CacheEntries)
+	prometheus.MustRegister(CircuitBreakerState)
+	prometheus.MustRegister(OutlierEjections)
+	prometheus.MustRegister(OutlierEjectedHosts)
 }
 
 // Handler returns the Prometheus metrics handler
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"strings"
 
+	"ai-api-gateway/internal/response"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -13,22 +15,14 @@ func AdminAuth() gin.HandlerFunc {
 		// Get user roles from context
 		roles, exists := c.Get("user_roles")
 		if !exists {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error":     "Forbidden",
-				"message":   "User roles not found",
-				"code":      http.StatusForbidden,
-			})
+			response.Error(c, http.StatusForbidden, "User roles not found")
 			c.Abort()
 			return
 		}
 
 		rolesSlice, ok := roles.([]string)
 		if !ok {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error":     "Forbidden",
-				"message":   "Invalid user roles",
-				"code":      http.StatusForbidden,
-			})
+			response.Error(c, http.StatusForbidden, "Invalid user roles")
 			c.Abort()
 			return
 		}
@@ -43,11 +37,7 @@ func AdminAuth() gin.HandlerFunc {
 		}
 
 		if !hasAdmin {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error":     "Forbidden",
-				"message":   "Admin role required",
-				"code":      http.StatusForbidden,
-			})
+			response.Error(c, http.StatusForbidden, "Admin role required")
 			c.Abort()
 			return
 		}
@@ -0,0 +1,328 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/response"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a streaming compressor that can be reused through Reset
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+// encoderPools returns pools of encoders for the given algorithms. Encoders
+// favor speed, as responses are compressed on every request.
+func encoderPools(algorithms []string) map[string]*sync.Pool {
+	pools := make(map[string]*sync.Pool, len(algorithms))
+	for _, algorithm := range algorithms {
+		var newEncoder func() encoder
+		switch algorithm {
+		case "gzip":
+			newEncoder = func() encoder {
+				w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+				return w
+			}
+		case "br":
+			newEncoder = func() encoder { return brotli.NewWriterLevel(io.Discard, 4) }
+		case "zstd":
+			newEncoder = func() encoder {
+				// Browsers decode windows of up to 8MB
+				w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+				return w
+			}
+		default:
+			continue
+		}
+		pools[algorithm] = &sync.Pool{New: func() interface{} { return newEncoder() }}
+	}
+	return pools
+}
+
+// Compression compresses responses with the best algorithm accepted by the
+// client, and decompresses gzip request bodies if configured. Responses are
+// compressed if their content type is listed and their body reaches the
+// minimum size; bodies already encoded by the upstream are passed through.
+// Streamed responses are compressed as they are flushed.
+func Compression(cfg config.CompressionConfig) gin.HandlerFunc {
+	pools := encoderPools(cfg.Algorithms)
+
+	return func(c *gin.Context) {
+		if cfg.DecompressRequests && !decompressRequest(c, cfg.MaxDecompressedSize) {
+			return
+		}
+
+		// Upgraded connections and gRPC, which compresses messages itself,
+		// are left alone
+		if !cfg.Enabled || c.Request.Header.Get("Upgrade") != "" || response.IsGRPC(c.Request) {
+			c.Next()
+			return
+		}
+
+		encoding := negotiateEncoding(c.Request.Header.Values("Accept-Encoding"), cfg.Algorithms)
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       encoding,
+			pool:           pools[encoding],
+			minSize:        cfg.MinSize,
+			contentTypes:   cfg.ContentTypes,
+		}
+		c.Writer = w
+		defer func() {
+			w.close()
+			c.Writer = w.ResponseWriter
+		}()
+
+		c.Next()
+	}
+}
+
+// decompressRequest replaces a gzip request body with its decompressed
+// content. It responds with an error and returns false if the body is not
+// valid gzip or decompresses to more than maxSize bytes.
+func decompressRequest(c *gin.Context, maxSize int) bool {
+	if !strings.EqualFold(strings.TrimSpace(c.Request.Header.Get("Content-Encoding")), "gzip") {
+		return true
+	}
+
+	reader, err := gzip.NewReader(c.Request.Body)
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+		if err == nil && len(body) > maxSize {
+			response.Error(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Decompressed request body exceeds maximum allowed size of %d bytes", maxSize))
+			c.Abort()
+			return false
+		}
+		if err == nil {
+			c.Request.Body.Close()
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Request.ContentLength = int64(len(body))
+			c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			c.Request.Header.Del("Content-Encoding")
+			return true
+		}
+	}
+
+	response.Error(c, http.StatusBadRequest, "Invalid gzip request body")
+	c.Abort()
+	return false
+}
+
+// negotiateEncoding returns the encoding to use for an Accept-Encoding
+// header: the supported encoding with the highest quality, the first in
+// supported on ties, or "" if none is acceptable
+func negotiateEncoding(values []string, supported []string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			quality := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if q, err := strconv.ParseFloat(v, 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			switch name {
+			case "":
+			case "*":
+				wildcard = quality
+			default:
+				qualities[name] = quality
+			}
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range supported {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressWriter compresses a response as it is written. The body is held
+// back until it reaches the minimum size, so that small responses are sent
+// as is; a flush, as in a streamed response, decides right away.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding     string
+	pool         *sync.Pool
+	minSize      int
+	contentTypes []string
+	buf          []byte
+	decided      bool
+	encoder      encoder // nil unless the response is compressed
+}
+
+// WriteHeaderNow writes the response headers once compression is decided
+func (w *compressWriter) WriteHeaderNow() {
+	if w.decided {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Write compresses part of the response body, or holds it back until
+// compression is decided
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString compresses part of the response body
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends the data written so far to the client, compressed if the
+// response is eligible whatever its size
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// decide writes the response headers, compressing the response if allowed
+// and eligible, then writes the held back body
+func (w *compressWriter) decide(allowed bool) error {
+	w.decided = true
+	header := w.Header()
+	eligible := w.eligible()
+	if eligible && !varies(header, "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if allowed && eligible {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		// The compressed body differs from the upstream's
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.encoder = w.pool.Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeaderNow()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// eligible reports whether the response may be compressed: it has a body and
+// a listed content type, is not encoded or partial already, and does not
+// forbid transformation
+func (w *compressWriter) eligible() bool {
+	header := w.Header()
+	status := w.Status()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range w.contentTypes {
+		if contentType == mediaType || (strings.HasSuffix(contentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(contentType, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// varies reports whether a response's Vary header lists name
+func varies(header http.Header, name string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// close finishes the response: bodies that never reached the minimum size
+// are written uncompressed, and the compressed stream is terminated
+func (w *compressWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.encoder == nil {
+		return
+	}
+	// A failed write means the client went away; the encoder is reusable
+	// after Reset either way
+	w.encoder.Close()
+	w.encoder.Reset(io.Discard)
+	w.pool.Put(w.encoder)
+	w.encoder = nil
+}
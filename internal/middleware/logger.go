@@ -32,6 +32,7 @@ func RequestLogger(logger *config.Logger) gin.HandlerFunc {
 			"user_agent": c.Request.UserAgent(),
 			"bytes_in":   c.Request.ContentLength,
 			"bytes_out":  c.Writer.Size(),
+			"request_id": c.GetString("request_id"),
 		}
 
 		// Log based on status code
@@ -2,10 +2,10 @@ package middleware
 
 import (
     "net/http"
-    "time"
 
     "ai-api-gateway/internal/metrics"
     "ai-api-gateway/internal/ratelimiter"
+    "ai-api-gateway/internal/response"
 
     "github.com/gin-gonic/gin"
 )
@@ -60,12 +60,7 @@ func (m *RateLimitMiddleware) Middleware() gin.HandlerFunc {
 
 		if !allowed {
 			metrics.RateLimitHits.WithLabelValues(key, m.algorithm).Inc()
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error":     "Too Many Requests",
-				"message":   "Rate limit exceeded",
-				"code":      http.StatusTooManyRequests,
-				"timestamp": time.Now().UTC().Format(time.RFC3339),
-			})
+			response.Error(c, http.StatusTooManyRequests, "Rate limit exceeded")
 			c.Abort()
 			return
 		}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 
+	"ai-api-gateway/internal/response"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -78,11 +80,7 @@ func CORS(allowedOrigins []string, allowedMethods []string, allowedHeaders []str
 func RequestSizeLimit(maxSize int64) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.ContentLength > maxSize {
-			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
-				"error":   "Request Entity Too Large",
-				"message": fmt.Sprintf("Request body size exceeds maximum allowed size of %d bytes", maxSize),
-				"code":    http.StatusRequestEntityTooLarge,
-			})
+			response.Error(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body size exceeds maximum allowed size of %d bytes", maxSize))
 			c.Abort()
 			return
 		}
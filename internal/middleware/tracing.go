@@ -30,6 +30,7 @@ func TracingMiddleware() gin.HandlerFunc {
 				semconv.HTTPRouteKey.String(c.FullPath()),
 				attribute.String("http.user_agent", c.Request.UserAgent()),
 				attribute.String("http.client_ip", c.ClientIP()),
+				attribute.String("http.request_id", c.GetString("request_id")),
 			),
 		)
 		defer span.End()
@@ -84,6 +84,12 @@ func NewWeightedRoundRobin(urls []string, weights []int) *WeightedRoundRobin {
 
 // Next returns the next URL using weighted round-robin
 func (wrr *WeightedRoundRobin) Next() string {
+	return wrr.NextAmong(nil)
+}
+
+// NextAmong returns the next URL using weighted round-robin, considering only
+// the given candidates. A nil candidate list allows every URL.
+func (wrr *WeightedRoundRobin) NextAmong(candidates []string) string {
 	wrr.mu.Lock()
 	defer wrr.mu.Unlock()
 
@@ -91,28 +97,42 @@ func (wrr *WeightedRoundRobin) Next() string {
 		return ""
 	}
 
-	// Find URL with maximum current weight
+	var allowed map[string]bool
+	if candidates != nil {
+		allowed = make(map[string]bool, len(candidates))
+		for _, url := range candidates {
+			allowed[url] = true
+		}
+	}
+
+	// Find allowed URL with maximum current weight
 	maxWeight := -1
-	maxIndex := 0
+	maxIndex := -1
+	totalWeight := 0
 
-	for i := range wrr.urls {
+	for i, url := range wrr.urls {
+		if allowed != nil && !allowed[url] {
+			continue
+		}
+		totalWeight += wrr.weights[i]
 		if wrr.current[i] > maxWeight {
 			maxWeight = wrr.current[i]
 			maxIndex = i
 		}
 	}
 
-	// Decrease current weight by total weight sum
-	totalWeight := 0
-	for _, w := range wrr.weights {
-		totalWeight += w
+	if maxIndex < 0 {
+		return ""
 	}
 
+	// Decrease current weight by total weight sum
 	wrr.current[maxIndex] -= totalWeight
 
-	// Increase all current weights by their base weights
-	for i := range wrr.current {
-		wrr.current[i] += wrr.weights[i]
+	// Increase all allowed current weights by their base weights
+	for i, url := range wrr.urls {
+		if allowed == nil || allowed[url] {
+			wrr.current[i] += wrr.weights[i]
+		}
 	}
 
 	return wrr.urls[maxIndex]
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests until the open duration has passed
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe requests through
+	CircuitHalfOpen
+)
+
+// String returns the name of the state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBuckets is the number of buckets the error-rate window is split into
+const circuitBuckets = 10
+
+// CircuitBreaker tracks failures of a single upstream URL and stops sending
+// it traffic while it is failing
+type CircuitBreaker struct {
+	upstream string
+	url      string
+	cfg      config.CircuitBreakerConfig
+
+	mu                sync.Mutex
+	state             CircuitState
+	openedAt          time.Time
+	consecutive       int
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	buckets           [circuitBuckets]circuitBucket
+}
+
+// circuitBucket counts requests and failures within one slice of the window
+type circuitBucket struct {
+	start    int64
+	requests int
+	failures int
+}
+
+// NewCircuitBreaker creates a closed circuit breaker for an upstream URL
+func NewCircuitBreaker(upstream, url string, cfg config.CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		upstream: upstream,
+		url:      url,
+		cfg:      cfg,
+	}
+	cb.publish()
+	return cb
+}
+
+// State returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Available reports whether the circuit would currently let a request through,
+// without reserving a half-open probe
+func (cb *CircuitBreaker) Available() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return time.Since(cb.openedAt) >= cb.cfg.OpenDuration
+	case CircuitHalfOpen:
+		return cb.halfOpenInFlight < cb.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Allow reports whether a request may be sent. An open circuit whose open
+// duration has passed turns half-open, and in the half-open state Allow
+// reserves one of the probe requests.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen {
+		if time.Since(cb.openedAt) < cb.cfg.OpenDuration {
+			return false
+		}
+		cb.setState(CircuitHalfOpen)
+	}
+
+	if cb.state == CircuitHalfOpen {
+		if cb.halfOpenInFlight >= cb.cfg.HalfOpenRequests {
+			return false
+		}
+		cb.halfOpenInFlight++
+	}
+
+	return true
+}
+
+// Record records the outcome of a request let through by Allow
+func (cb *CircuitBreaker) Record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+		if !success {
+			cb.setState(CircuitOpen)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.cfg.HalfOpenRequests {
+			cb.setState(CircuitClosed)
+		}
+
+	case CircuitClosed:
+		bucket := cb.bucket(time.Now())
+		bucket.requests++
+		if success {
+			cb.consecutive = 0
+			return
+		}
+		bucket.failures++
+		cb.consecutive++
+
+		if cb.cfg.ConsecutiveFailures > 0 && cb.consecutive >= cb.cfg.ConsecutiveFailures {
+			cb.setState(CircuitOpen)
+			return
+		}
+		if cb.cfg.ErrorRate > 0 {
+			requests, failures := cb.windowCounts(time.Now())
+			if requests >= cb.cfg.MinRequests && float64(failures)/float64(requests) >= cb.cfg.ErrorRate {
+				cb.setState(CircuitOpen)
+			}
+		}
+	}
+}
+
+// Release gives back a half-open probe reservation for a request whose
+// outcome says nothing about the URL, such as one cancelled by the client
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight--
+	}
+}
+
+// setState moves the circuit to a new state, resetting the counters that
+// belong to the old one. The caller must hold mu.
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	cb.consecutive = 0
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = time.Now()
+	case CircuitClosed:
+		cb.buckets = [circuitBuckets]circuitBucket{}
+	}
+
+	cb.publish()
+}
+
+// publish exports the circuit state as a gauge
+func (cb *CircuitBreaker) publish() {
+	metrics.CircuitBreakerState.WithLabelValues(cb.upstream, cb.url).Set(float64(cb.state))
+}
+
+// bucketSize returns the length of one window bucket
+func (cb *CircuitBreaker) bucketSize() int64 {
+	size := int64(cb.cfg.Window) / circuitBuckets
+	if size <= 0 {
+		size = int64(time.Second)
+	}
+	return size
+}
+
+// bucket returns the bucket for the given time, resetting it if it holds
+// counts from an earlier window. The caller must hold mu.
+func (cb *CircuitBreaker) bucket(now time.Time) *circuitBucket {
+	size := cb.bucketSize()
+	start := now.UnixNano() / size * size
+	bucket := &cb.buckets[(start/size)%circuitBuckets]
+	if bucket.start != start {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+// windowCounts sums the requests and failures within the window. The caller
+// must hold mu.
+func (cb *CircuitBreaker) windowCounts(now time.Time) (requests, failures int) {
+	oldest := now.UnixNano() - cb.bucketSize()*circuitBuckets
+	for _, bucket := range cb.buckets {
+		if bucket.start > oldest {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
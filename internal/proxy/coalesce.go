@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// coalescer collapses identical requests in flight at the same time into a
+// single upstream request, so a burst of requests for a cold resource reaches
+// the upstream once
+type coalescer struct {
+	varyHeaders []string
+	maxBodySize int
+	mu          sync.Mutex
+	calls       map[string]*coalescedCall
+}
+
+// coalescedCall is an upstream request that identical requests wait on
+type coalescedCall struct {
+	done     chan struct{}
+	response *sharedResponse // nil if the response cannot be shared
+}
+
+// sharedResponse is a complete upstream response handed to the requests that
+// waited on it
+type sharedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	request http.Header // headers of the request that was sent upstream
+}
+
+// newCoalescer creates a coalescer, or returns nil if coalescing is disabled
+func newCoalescer(cfg config.CoalesceConfig) *coalescer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &coalescer{
+		varyHeaders: cfg.VaryHeaders,
+		maxBodySize: cfg.MaxBodySize,
+		calls:       make(map[string]*coalescedCall),
+	}
+}
+
+// uncoalescibleHeaders are request headers whose response depends on what the
+// client already has: conditional and Range requests
+var uncoalescibleHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"}
+
+// coalescible reports whether a request may be collapsed with identical ones:
+// GET and HEAD requests without a body that are neither conditional nor for
+// a range
+func coalescible(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.ContentLength != 0 || len(req.TransferEncoding) != 0 {
+		return false
+	}
+	for _, name := range uncoalescibleHeaders {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// key identifies identical requests: the method, the upstream target, the
+// values of the vary headers as the client sent them, and the values of the
+// headers set by request header rules, which may be rendered from the
+// client's claims or address
+func (co *coalescer) key(req *http.Request, client http.Header, upstream, path, rawQuery string, headers headerPolicies) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteString(" ")
+	b.WriteString(upstream)
+	b.WriteString(path)
+	if rawQuery != "" {
+		b.WriteString("?")
+		b.WriteString(rawQuery)
+	}
+	for _, name := range co.varyHeaders {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(client.Values(name), ","))
+	}
+	for _, name := range headers.requestHeaderNames() {
+		b.WriteString("\nrewritten ")
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// join returns the call in flight for key, or starts one if there is none.
+// The caller that starts a call must finish it.
+func (co *coalescer) join(key string) (call *coalescedCall, leader bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if call, ok := co.calls[key]; ok {
+		return call, false
+	}
+	call = &coalescedCall{done: make(chan struct{})}
+	co.calls[key] = call
+	return call, true
+}
+
+// finish hands the response of a call to the requests waiting on it
+func (co *coalescer) finish(key string, call *coalescedCall, response *sharedResponse) {
+	co.mu.Lock()
+	delete(co.calls, key)
+	co.mu.Unlock()
+
+	call.response = response
+	close(call.done)
+}
+
+// coalesce forwards a request upstream unless an identical request is
+// already in flight, in which case it waits for that request's response and
+// serves it. clientHeader holds the headers of the request before they were
+// rewritten. Requests fall back to being forwarded on their own when the
+// response cannot be shared: it was streamed, too large, an error, set a
+// cookie or varies on headers that differ.
+func (r *Router) coalesce(c *gin.Context, upstream *Upstream, path, rawQuery string, headers headerPolicies, clientHeader http.Header) {
+	key := r.coalescer.key(c.Request, clientHeader, upstream.Name, path, rawQuery, headers)
+	call, leader := r.coalescer.join(key)
+	if leader {
+		w := &sharingWriter{ResponseWriter: c.Writer, limit: r.coalescer.maxBodySize}
+		c.Writer = w
+		defer func() {
+			c.Writer = w.ResponseWriter
+			r.coalescer.finish(key, call, w.shared(c.Request))
+		}()
+		r.forward(c, upstream, path, rawQuery, headers)
+		w.complete = true
+		return
+	}
+
+	select {
+	case <-call.done:
+	case <-c.Request.Context().Done():
+		// Answer the client unless it went away
+		if cause := context.Cause(c.Request.Context()); errors.Is(cause, errUpstreamTimeout) {
+			writeUpstreamError(c, cause)
+		}
+		return
+	}
+
+	if call.response == nil || !call.response.matches(c.Request.Header) {
+		r.forward(c, upstream, path, rawQuery, headers)
+		return
+	}
+
+	metrics.UpstreamCoalescedRequests.WithLabelValues(upstream.Name).Inc()
+	call.response.write(c)
+}
+
+// matches reports whether the response may be served to a request with the
+// given headers, according to the response's Vary header
+func (s *sharedResponse) matches(header http.Header) bool {
+	for _, value := range s.header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return false
+			}
+			if name != "" && strings.Join(header.Values(name), ",") != strings.Join(s.request.Values(name), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// write sends the response to a client
+func (s *sharedResponse) write(c *gin.Context) {
+	header := c.Writer.Header()
+	for name, values := range s.header {
+		header[name] = append([]string(nil), values...)
+	}
+	c.Status(s.status)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Write(s.body)
+}
+
+// sharingWriter copies a response into a buffer as it is written to the
+// client, so that it can be shared once complete
+type sharingWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	limit    int
+	overflow bool // the body exceeded limit and is not kept
+	flushed  bool // the response was streamed
+	failed   bool // writing to the client failed
+	complete bool // the response was written in full
+}
+
+// Write writes and buffers part of the response body
+func (w *sharingWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// WriteString writes and buffers part of the response body
+func (w *sharingWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	n, err := w.ResponseWriter.WriteString(s)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// Flush sends buffered data to the client. Streamed responses are not shared.
+func (w *sharingWriter) Flush() {
+	w.flushed = true
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController
+func (w *sharingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// capture buffers data unless the body grew beyond the limit
+func (w *sharingWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.limit {
+		w.overflow = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
+}
+
+// shared returns the response written for req, or nil if it may not be
+// shared. Error responses are not shared, so that waiting requests get their
+// own chance at the upstream, and neither are 304 and 206 responses, which
+// only make sense to the client that asked for them.
+func (w *sharingWriter) shared(req *http.Request) *sharedResponse {
+	header := w.Header()
+	if !w.complete || w.overflow || w.flushed || w.failed || req.Context().Err() != nil {
+		return nil
+	}
+	status := w.Status()
+	if status >= http.StatusInternalServerError || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return nil
+	}
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	response := &sharedResponse{
+		status:  status,
+		header:  header.Clone(),
+		body:    w.body.Bytes(),
+		request: req.Header.Clone(),
+	}
+	response.header.Del("X-Request-ID")
+	return response
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/metrics"
+)
+
+// ewmaDecay is the time constant of the latency averages: an observation
+// loses about two thirds of its weight after this long
+const ewmaDecay = 10 * time.Second
+
+// LatencyTracker keeps a peak-sensitive exponentially weighted moving average
+// of the response latency of each upstream URL. A latency above the average
+// replaces it at once, so a slowing URL is avoided immediately, while lower
+// latencies are blended in over time. Averages also decay towards zero while
+// a URL gets no requests, so a URL avoided after one slow response or failure
+// is eventually tried again.
+type LatencyTracker struct {
+	mu    sync.Mutex
+	stats map[string]*ewmaStat
+}
+
+// ewmaStat holds the latency average of one URL
+type ewmaStat struct {
+	value float64 // seconds
+	last  time.Time
+}
+
+// NewLatencyTracker creates a new latency tracker
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{
+		stats: make(map[string]*ewmaStat),
+	}
+}
+
+// Observe records the latency of a response from a URL
+func (lt *LatencyTracker) Observe(upstream, url string, latency time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	now := time.Now()
+	sample := latency.Seconds()
+	stat, ok := lt.stats[url]
+	switch {
+	case !ok:
+		stat = &ewmaStat{value: sample}
+		lt.stats[url] = stat
+	case sample > stat.decayed(now):
+		stat.value = sample
+	default:
+		weight := stat.weight(now)
+		stat.value = stat.value*weight + sample*(1-weight)
+	}
+	stat.last = now
+
+	metrics.UpstreamLatencyEWMA.WithLabelValues(upstream, url).Set(stat.value)
+}
+
+// Cost returns the expected cost of sending a request to a URL: its latency
+// average scaled by the requests already in flight to it. URLs without
+// observations cost nothing, so new URLs are tried first.
+func (lt *LatencyTracker) Cost(url string, inFlight int) float64 {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	stat, ok := lt.stats[url]
+	if !ok {
+		return 0
+	}
+	return stat.decayed(time.Now()) * float64(inFlight+1)
+}
+
+// weight returns the weight left to the average after the time since the
+// last observation
+func (s *ewmaStat) weight(now time.Time) float64 {
+	return math.Exp(-float64(now.Sub(s.last)) / float64(ewmaDecay))
+}
+
+// decayed returns the average decayed towards zero for the time since the
+// last observation, as if requests that took no time had been observed
+func (s *ewmaStat) decayed(now time.Time) float64 {
+	return s.value * s.weight(now)
+}
+
+// p2cEWMA picks two random candidates and selects the one with the lower
+// latency cost
+func (r *Router) p2cEWMA(urls []string) string {
+	if len(urls) == 1 {
+		return urls[0]
+	}
+
+	i := rand.Intn(len(urls))
+	j := rand.Intn(len(urls) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := urls[i], urls[j]
+	if r.latency.Cost(b, r.connTracker.GetCount(b)) < r.latency.Cost(a, r.connTracker.GetCount(a)) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyTrackerRecoversAfterFailure(t *testing.T) {
+	lt := NewLatencyTracker()
+
+	// A failure counts as taking the whole proxy timeout
+	lt.Observe("chat", "http://chat-1:8000", 30*time.Second)
+	lt.Observe("chat", "http://chat-2:8000", 20*time.Millisecond)
+	assert.Greater(t, lt.Cost("http://chat-1:8000", 0), lt.Cost("http://chat-2:8000", 0))
+
+	// While the other URL keeps serving requests, the failed URL's average
+	// decays until it is cheaper and tried again
+	for _, stat := range lt.stats {
+		stat.last = stat.last.Add(-2 * time.Minute)
+	}
+	lt.Observe("chat", "http://chat-2:8000", 20*time.Millisecond)
+	assert.Less(t, lt.Cost("http://chat-1:8000", 0), lt.Cost("http://chat-2:8000", 0))
+
+	// A fast response then brings its average down for good
+	lt.Observe("chat", "http://chat-1:8000", 10*time.Millisecond)
+	assert.Less(t, lt.Cost("http://chat-1:8000", 0), lt.Cost("http://chat-2:8000", 0))
+}
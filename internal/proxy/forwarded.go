@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseTrustedProxies parses IP addresses and CIDRs of trusted proxies
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy
+func (r *Router) isTrustedProxy(ip net.IP) bool {
+	for _, network := range r.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardingHeaders adds this hop to the X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers of the request
+// in c, writing them to header before the request is forwarded. Forwarding
+// headers received from a trusted proxy are extended; those received from
+// anyone else are replaced, so clients cannot spoof their address.
+func (r *Router) setForwardingHeaders(c *gin.Context, header http.Header) {
+	peer := c.RemoteIP()
+	trusted := r.isTrustedProxy(net.ParseIP(peer))
+
+	proto := "http"
+	if c.Request.TLS != nil {
+		proto = "https"
+	}
+	host := c.Request.Host
+
+	if !trusted {
+		header.Del("X-Forwarded-For")
+		header.Del("X-Forwarded-Proto")
+		header.Del("X-Forwarded-Host")
+		header.Del("Forwarded")
+	}
+
+	if prior := strings.Join(header.Values("X-Forwarded-For"), ", "); prior != "" {
+		header.Set("X-Forwarded-For", prior+", "+peer)
+	} else {
+		header.Set("X-Forwarded-For", peer)
+	}
+
+	// The original protocol and host are those seen by the first proxy
+	if header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", host)
+	}
+
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), forwardedValue(host), proto)
+	if prior := strings.Join(header.Values("Forwarded"), ", "); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	header.Set("Forwarded", forwarded)
+}
+
+// forwardedNode formats an IP address as a node of a Forwarded header, where
+// IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes a Forwarded header value unless it is a token
+func forwardedValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, "\"(),/:;<=>?@[\\]{} \t") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+}
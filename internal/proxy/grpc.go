@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+	"ai-api-gateway/internal/response"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+// newUpstreamClient returns the client used to reach an upstream speaking the
+// given protocol. HTTP/1.1 upstreams share the router's client.
+func newUpstreamClient(protocol string, cfg *config.ProxyConfig, shared *http.Client) *http.Client {
+	switch protocol {
+	case "h2c":
+		// HTTP/2 with prior knowledge over plain TCP
+		return &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					// Report the dial like http.Transport does, so that
+					// connect timeouts apply
+					trace := httptrace.ContextClientTrace(ctx)
+					if trace != nil && trace.ConnectStart != nil {
+						trace.ConnectStart(network, addr)
+					}
+					var dialer net.Dialer
+					conn, err := dialer.DialContext(ctx, network, addr)
+					if trace != nil && trace.ConnectDone != nil {
+						trace.ConnectDone(network, addr, err)
+					}
+					return conn, err
+				},
+			},
+		}
+	case "h2":
+		return &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:      cfg.MaxIdleConns,
+				IdleConnTimeout:   cfg.IdleConnTimeout,
+				ForceAttemptHTTP2: true,
+			},
+		}
+	default:
+		return shared
+	}
+}
+
+// copyTrailers forwards the trailers of an upstream response to the client.
+// It must be called once the response body has been read.
+func copyTrailers(c *gin.Context, resp *http.Response) {
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			c.Writer.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// recordGRPC records the outcome of a proxied gRPC call. The status code is
+// read from the trailers, or from the headers of a trailers-only response.
+func recordGRPC(at *upstreamAttempt) {
+	resp := at.resp
+	code := resp.Trailer.Get("Grpc-Status")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+	}
+	if code == "" {
+		code = strconv.Itoa(response.GRPCStatus(resp.StatusCode))
+	}
+
+	service, method := grpcMethod(resp.Request.URL.Path)
+	metrics.UpstreamGRPCRequests.WithLabelValues(at.upstream.Name, service, method, code).Inc()
+	metrics.UpstreamGRPCRequestDuration.WithLabelValues(at.upstream.Name, service, method, code).Observe(time.Since(at.start).Seconds())
+}
+
+// grpcMethod splits a gRPC request path of the form /package.Service/Method
+// into its service and method. Any prefix before the service is ignored.
+func grpcMethod(path string) (service, method string) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return "unknown", "unknown"
+	}
+	method = path[i+1:]
+	service = path[strings.LastIndex(path[:i], "/")+1 : i]
+	if service == "" {
+		return "unknown", "unknown"
+	}
+	return service, method
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HashRing implements consistent hashing over the URLs of an upstream. Each
+// URL is placed on the ring at several points, so that removing a URL only
+// moves the keys that mapped to it.
+type HashRing struct {
+	points []ringPoint // sorted by hash
+}
+
+// ringPoint is one position of a URL on the ring
+type ringPoint struct {
+	hash uint64
+	url  string
+}
+
+// NewHashRing creates a ring with virtualNodes points per URL and unit of
+// weight
+func NewHashRing(urls []string, weights []int, virtualNodes int) *HashRing {
+	ring := &HashRing{}
+	for i, u := range urls {
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		for n := 0; n < virtualNodes*weight; n++ {
+			ring.points = append(ring.points, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", u, n)), url: u})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring
+}
+
+// Get returns the first URL among allowed found clockwise from the key
+func (h *HashRing) Get(key string, allowed []string) string {
+	if len(h.points) == 0 || len(allowed) == 0 {
+		return ""
+	}
+
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, u := range allowed {
+		allowedSet[u] = true
+	}
+
+	hash := hashString(key)
+	start := sort.Search(len(h.points), func(i int) bool { return h.points[i].hash >= hash })
+	for i := 0; i < len(h.points); i++ {
+		point := h.points[(start+i)%len(h.points)]
+		if allowedSet[point.url] {
+			return point.url
+		}
+	}
+	return ""
+}
+
+// hashString hashes a string with FNV-1a, followed by a finalizer that
+// spreads similar strings across the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashKey returns the consistent hashing key of a request, or an empty
+// string if the request does not carry one
+func (r *Router) hashKey(c *gin.Context) string {
+	cfg := r.config.ConsistentHash
+	switch cfg.Source {
+	case "header":
+		return c.GetHeader(cfg.Name)
+	case "cookie":
+		value, _ := c.Cookie(cfg.Name)
+		return value
+	case "user_id":
+		return c.GetString("user_id")
+	case "client_ip":
+		return c.ClientIP()
+	case "body_field":
+		return r.bodyField(c, cfg.Name)
+	}
+	return ""
+}
+
+// bodyField reads a dot-separated field from a JSON request body. The body is
+// restored so it can still be forwarded; bodies too large to buffer yield no
+// key.
+func (r *Router) bodyField(c *gin.Context, field string) string {
+	data, rest, ok, err := bufferBody(c.Request.Body, r.config.MaxBufferedBodySize)
+	if err != nil {
+		c.Request.Body = failedBody{err}
+		return ""
+	}
+	if !ok {
+		c.Request.Body = rest
+		return ""
+	}
+	if data == nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return ""
+	}
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+
+	switch v := value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
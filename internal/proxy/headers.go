@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"ai-api-gateway/internal/auth"
+	"ai-api-gateway/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerPolicy holds the compiled header rules of an upstream or a route
+type headerPolicy struct {
+	request  *headerRules // nil if no request header rules are configured
+	response *headerRules // nil if no response header rules are configured
+}
+
+// newHeaderPolicy compiles header rules
+func newHeaderPolicy(cfg config.HeaderPolicy) (headerPolicy, error) {
+	request, err := newHeaderRules(cfg.Request)
+	if err != nil {
+		return headerPolicy{}, err
+	}
+	response, err := newHeaderRules(cfg.Response)
+	if err != nil {
+		return headerPolicy{}, err
+	}
+	return headerPolicy{request: request, response: response}, nil
+}
+
+// headerPolicies are the header policies that apply to a request, in the
+// order they are applied
+type headerPolicies []headerPolicy
+
+// rewriteRequest applies the request header rules to header, the headers of
+// the client request or of a copy of it
+func (p headerPolicies) rewriteRequest(c *gin.Context, header http.Header) {
+	for _, policy := range p {
+		if policy.request != nil {
+			policy.request.apply(c, header)
+		}
+	}
+}
+
+// requestHeaderNames returns the sorted names of the request headers the
+// rules rename to, set or append to
+func (p headerPolicies) requestHeaderNames() []string {
+	var names []string
+	for _, policy := range p {
+		if policy.request == nil {
+			continue
+		}
+		for _, to := range policy.request.rename {
+			names = append(names, http.CanonicalHeaderKey(to))
+		}
+		for _, value := range policy.request.set {
+			names = append(names, http.CanonicalHeaderKey(value.name))
+		}
+		for _, value := range policy.request.append {
+			names = append(names, http.CanonicalHeaderKey(value.name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rewriteResponse applies the response header rules to an upstream response
+func (p headerPolicies) rewriteResponse(c *gin.Context, header http.Header) {
+	for _, policy := range p {
+		if policy.response != nil {
+			policy.response.apply(c, header)
+		}
+	}
+}
+
+// headerRules is a compiled config.HeaderRules
+type headerRules struct {
+	rename map[string]string
+	remove []string
+	set    []headerValue
+	append []headerValue
+}
+
+// headerValue is a header value template
+type headerValue struct {
+	name     string
+	template []config.TemplatePart
+}
+
+// newHeaderRules compiles header rules, returning nil if none are configured
+func newHeaderRules(cfg config.HeaderRules) (*headerRules, error) {
+	if !cfg.IsSet() {
+		return nil, nil
+	}
+
+	rules := &headerRules{
+		rename: make(map[string]string, len(cfg.Rename)),
+		remove: cfg.Remove,
+	}
+	for from, to := range cfg.Rename {
+		rules.rename[from] = to
+	}
+
+	var err error
+	if rules.set, err = newHeaderValues(cfg.Set); err != nil {
+		return nil, err
+	}
+	if rules.append, err = newHeaderValues(cfg.Append); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// newHeaderValues parses header value templates, sorted by header name so
+// they are applied in a stable order
+func newHeaderValues(values map[string]string) ([]headerValue, error) {
+	headers := make([]headerValue, 0, len(values))
+	for name, value := range values {
+		template, err := config.ParseHeaderTemplate(value)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, headerValue{name: name, template: template})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	return headers, nil
+}
+
+// apply modifies header: headers are renamed first, then removed, then set,
+// then appended to
+func (h *headerRules) apply(c *gin.Context, header http.Header) {
+	for from, to := range h.rename {
+		if values := header.Values(from); len(values) > 0 {
+			values = append([]string(nil), values...)
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+	for _, name := range h.remove {
+		header.Del(name)
+	}
+	for _, value := range h.set {
+		header.Set(value.name, value.render(c))
+	}
+	for _, value := range h.append {
+		header.Add(value.name, value.render(c))
+	}
+}
+
+// render fills in the placeholders of a header value template
+func (v headerValue) render(c *gin.Context) string {
+	var b strings.Builder
+	for _, part := range v.template {
+		switch {
+		case part.Variable == "":
+			b.WriteString(part.Literal)
+		case part.Variable == "client_ip":
+			b.WriteString(c.ClientIP())
+		case part.Variable == "request_id":
+			b.WriteString(requestID(c))
+		default:
+			claims, _ := auth.GetClaimsFromContext(c.Request.Context())
+			b.WriteString(strings.Join(auth.ClaimValues(claims, strings.TrimPrefix(part.Variable, "claims.")), ","))
+		}
+	}
+	return b.String()
+}
+
+// requestID returns the ID of a request
+func requestID(c *gin.Context) string {
+	if id := c.GetString("request_id"); id != "" {
+		return id
+	}
+	return c.GetHeader("X-Request-ID")
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"ai-api-gateway/internal/config"
 )
 
 // HealthChecker checks health of upstream services
@@ -17,22 +19,20 @@ type HealthChecker struct {
 	mu         sync.RWMutex
 	httpClient *http.Client
 	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
 // NewHealthChecker creates a new health checker
-func NewHealthChecker(upstream *Upstream, config struct {
-	Path     string
-	Interval time.Duration
-	Timeout  time.Duration
-}) *HealthChecker {
+func NewHealthChecker(upstream *Upstream, cfg config.HealthCheckConfig) *HealthChecker {
 	return &HealthChecker{
 		upstream: upstream,
-		path:     config.Path,
-		interval: config.Interval,
-		timeout:  config.Timeout,
+		path:     cfg.Path,
+		interval: cfg.Interval,
+		timeout:  cfg.Timeout,
 		healthy:  make(map[string]bool),
 		httpClient: &http.Client{
-			Timeout: config.Timeout,
+			Transport: upstream.client.Transport,
+			Timeout:   cfg.Timeout,
 		},
 		stop: make(chan struct{}),
 	}
@@ -56,9 +56,11 @@ func (hc *HealthChecker) Start() {
 	}
 }
 
-// Stop stops the health checker
+// Stop stops the health checker. It is safe to call more than once.
 func (hc *HealthChecker) Stop() {
-	close(hc.stop)
+	hc.stopOnce.Do(func() {
+		close(hc.stop)
+	})
 }
 
 // checkAll checks health of all upstream URLs
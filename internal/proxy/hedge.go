@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// hedgeLatencySamples is the number of recent response latencies kept to
+	// compute the hedge delay percentile
+	hedgeLatencySamples = 200
+
+	// hedgeMinSamples is the number of latencies needed before the observed
+	// percentile is trusted
+	hedgeMinSamples = 20
+)
+
+// hedgePolicy decides when a duplicate of a slow request is sent to a second
+// URL of the upstream
+type hedgePolicy struct {
+	delay      time.Duration
+	percentile float64
+	budget     *RetryBudget   // hedges are budgeted like retries
+	latency    *latencyWindow // nil unless the delay follows a percentile
+}
+
+// newHedgePolicy creates a hedge policy from its configuration
+func newHedgePolicy(cfg config.HedgeConfig) hedgePolicy {
+	if !cfg.Enabled() {
+		return hedgePolicy{}
+	}
+
+	policy := hedgePolicy{
+		delay:      cfg.Delay,
+		percentile: cfg.Percentile,
+		budget: NewRetryBudget(config.RetryBudgetConfig{
+			Ratio:               cfg.BudgetRatio,
+			MinRetriesPerSecond: cfg.MinPerSecond,
+		}),
+	}
+	if cfg.Percentile > 0 {
+		policy.latency = &latencyWindow{}
+	}
+	return policy
+}
+
+// enabled reports whether requests may be hedged
+func (p hedgePolicy) enabled() bool {
+	return p.budget != nil
+}
+
+// hedgeDelay returns how long to wait for a response before hedging. It is
+// false until a delay is known.
+func (p hedgePolicy) hedgeDelay() (time.Duration, bool) {
+	if p.latency != nil {
+		if delay, ok := p.latency.percentile(p.percentile); ok {
+			return delay, true
+		}
+	}
+	return p.delay, p.delay > 0
+}
+
+// observe records the time an upstream took to respond
+func (p hedgePolicy) observe(latency time.Duration) {
+	if p.latency != nil {
+		p.latency.observe(latency)
+	}
+}
+
+// latencyWindow keeps the most recent response latencies of an upstream
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// observe adds a latency, replacing the oldest one once the window is full
+func (w *latencyWindow) observe(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.samples) < hedgeLatencySamples {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % hedgeLatencySamples
+}
+
+// percentile returns the given percentile of the window. It is false while
+// too few latencies have been observed.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if len(w.samples) < hedgeMinSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index], true
+}
+
+// hedgeResult is the outcome of an attempt sent in the background
+type hedgeResult struct {
+	at    *upstreamAttempt
+	err   error
+	index int // position of the attempt's cancel func
+}
+
+// hedgedRoundTrip sends an attempt to upstreamURL and, if it has not received
+// a response within the hedge delay and the hedge budget allows, a duplicate
+// to another URL selected for the request. The first response wins and the
+// other attempt is cancelled; a failed attempt gives way to the one still
+// running. The hedge URL is marked as tried. The body must be replayable.
+func (r *Router) hedgedRoundTrip(c *gin.Context, upstream *Upstream, upstreamURL string, sel *selection, path, rawQuery string, body []byte) (*upstreamAttempt, error) {
+	hedge := upstream.Hedge
+	delay, ok := hedge.hedgeDelay()
+	if !ok {
+		return r.roundTrip(c, upstream, upstreamURL, path, rawQuery, body, true, false)
+	}
+	hedge.budget.RecordRequest()
+
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	send := func(target string, hedged bool) {
+		// Each attempt gets its own context so the loser can be cancelled
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		cc := c.Copy()
+		cc.Request = c.Request.WithContext(ctx)
+		go func() {
+			at, err := r.roundTrip(cc, upstream, target, path, rawQuery, body, true, hedged)
+			results <- hedgeResult{at: at, err: err, index: index}
+		}()
+	}
+	send(upstreamURL, false)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil || pending == 0 {
+				res.at.done = append(res.at.done, cancels[res.index])
+				if pending > 0 {
+					for i, cancel := range cancels {
+						if i != res.index {
+							cancel()
+						}
+					}
+					go discardAttempts(upstream, results, pending)
+				}
+				return res.at, res.err
+			}
+
+			// Wait for the other attempt instead
+			upstream.recordOutcome(res.at.url, nil, res.err, c.Request.Context().Err() != nil)
+			res.at.release()
+			cancels[res.index]()
+
+		case <-timer.C:
+			hedgeURL := r.selectUpstream(upstream, sel)
+			if hedgeURL == "" {
+				continue
+			}
+			if sel.tried[hedgeURL] || !hedge.budget.TryRetry() {
+				// No other URL to hedge to, or no budget left
+				if breaker := upstream.Breakers[hedgeURL]; breaker != nil {
+					breaker.Release()
+				}
+				continue
+			}
+			sel.tried[hedgeURL] = true
+			pending++
+			send(hedgeURL, true)
+		}
+	}
+}
+
+// discardAttempts releases the attempts that lost a hedge race once they
+// return. Attempts cut short by cancellation are not held against their URL.
+func discardAttempts(upstream *Upstream, results <-chan hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.at.resp != nil {
+			res.at.resp.Body.Close()
+		}
+		upstream.recordOutcome(res.at.url, res.at.resp, res.err, true)
+		res.at.release()
+	}
+}
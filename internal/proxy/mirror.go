@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mirrorQueue sends mirrored requests on a fixed number of workers, so that
+// mirroring never holds up or slows down the primary request
+type mirrorQueue struct {
+	requests chan *mirrorRequest
+	stop     chan struct{}
+}
+
+// mirrorRequest is a copy of a request to be sent to a shadow upstream
+type mirrorRequest struct {
+	upstream *Upstream
+	method   string
+	path     string
+	rawQuery string
+	header   http.Header
+	body     []byte
+}
+
+// newMirrorQueue starts the workers of a mirror queue
+func newMirrorQueue(cfg config.MirrorConfig, send func(*mirrorRequest)) *mirrorQueue {
+	q := &mirrorQueue{
+		requests: make(chan *mirrorRequest, cfg.QueueSize),
+		stop:     make(chan struct{}),
+	}
+	for i := 0; i < cfg.Concurrency; i++ {
+		go func() {
+			for {
+				select {
+				case req := <-q.requests:
+					send(req)
+				case <-q.stop:
+					return
+				}
+			}
+		}()
+	}
+	return q
+}
+
+// enqueue queues a mirrored request. It returns false without waiting if
+// the queue is full.
+func (q *mirrorQueue) enqueue(req *mirrorRequest) bool {
+	select {
+	case q.requests <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the workers. Queued requests are dropped.
+func (q *mirrorQueue) close() {
+	close(q.stop)
+}
+
+// mirror copies a sampled share of the requests of a route, including their
+// body, to the route's shadow upstream. The copy gets its forwarding headers
+// and the header rules of the shadow upstream and the route here, while the
+// request they are rendered from is still being served.
+func (r *Router) mirror(c *gin.Context, route *Route, path, rawQuery string) {
+	policy := route.mirror
+	if r.mirrors == nil || policy.Upstream == "" || rand.Float64()*100 >= policy.Percentage {
+		return
+	}
+	upstream, ok := r.upstreams[policy.Upstream]
+	if !ok || isWebSocketUpgrade(c.Request) {
+		return
+	}
+
+	// Read the body so both the primary and the mirrored request can send it.
+	// Bodies too large to buffer are not mirrored.
+	data, rest, ok, err := bufferBody(c.Request.Body, r.config.MaxBufferedBodySize)
+	if err != nil {
+		c.Request.Body = failedBody{err}
+		return
+	}
+	if !ok {
+		c.Request.Body = rest
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "dropped").Inc()
+		return
+	}
+	if data != nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	header := c.Request.Header.Clone()
+	r.setForwardingHeaders(c, header)
+	headerPolicies{upstream.Headers, route.rewrites}.rewriteRequest(c, header)
+
+	queued := r.mirrors.enqueue(&mirrorRequest{
+		upstream: upstream,
+		method:   c.Request.Method,
+		path:     path,
+		rawQuery: rawQuery,
+		header:   header,
+		body:     data,
+	})
+	if !queued {
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "dropped").Inc()
+	}
+}
+
+// sendMirror sends a mirrored request and discards the response
+func (r *Router) sendMirror(m *mirrorRequest) {
+	upstream := m.upstream
+	upstreamURL := r.selectUpstream(upstream, &selection{})
+	if upstreamURL == "" {
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "dropped").Inc()
+		return
+	}
+
+	ctx := context.Background()
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+
+	targetURL, err := url.Parse(upstreamURL)
+	if err != nil {
+		upstream.recordOutcome(upstreamURL, nil, err, true)
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "error").Inc()
+		return
+	}
+	targetURL.Path = joinPath(targetURL.Path, m.path)
+	targetURL.RawPath = ""
+	targetURL.RawQuery = m.rawQuery
+
+	req, err := http.NewRequestWithContext(ctx, m.method, targetURL.String(), bytes.NewReader(m.body))
+	if err != nil {
+		upstream.recordOutcome(upstreamURL, nil, err, true)
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "error").Inc()
+		return
+	}
+	req.Header = m.header
+	removeHopHeaders(req.Header)
+
+	resp, err := upstream.client.Do(req)
+	upstream.recordOutcome(upstreamURL, resp, err, false)
+	if err != nil {
+		metrics.MirrorRequests.WithLabelValues(upstream.Name, "error").Inc()
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	metrics.MirrorRequests.WithLabelValues(upstream.Name, "sent").Inc()
+}
+
+// failedBody is a request body whose reads fail with err
+type failedBody struct {
+	err error
+}
+
+// Read returns the error
+func (b failedBody) Read([]byte) (int, error) {
+	return 0, b.err
+}
+
+// Close does nothing
+func (b failedBody) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+)
+
+// OutlierDetector passively tracks the outcome of live requests to the URLs
+// of an upstream and ejects URLs that keep failing from load balancing
+type OutlierDetector struct {
+	upstream string
+	cfg      config.OutlierDetectionConfig
+	logger   *config.Logger
+	mu       sync.Mutex
+	hosts    map[string]*outlierHost
+}
+
+// outlierHost holds the detection state of one upstream URL
+type outlierHost struct {
+	consecutive  int
+	ejections    int // times ejected, used to escalate the ejection period
+	ejected      bool
+	ejectedUntil time.Time
+	returnedAt   time.Time
+}
+
+// NewOutlierDetector creates an outlier detector for the given upstream URLs
+func NewOutlierDetector(upstream string, urls []string, cfg config.OutlierDetectionConfig, logger *config.Logger) *OutlierDetector {
+	od := &OutlierDetector{
+		upstream: upstream,
+		cfg:      cfg,
+		logger:   logger,
+		hosts:    make(map[string]*outlierHost, len(urls)),
+	}
+	for _, url := range urls {
+		od.hosts[url] = &outlierHost{}
+	}
+	metrics.OutlierEjectedHosts.WithLabelValues(upstream).Set(0)
+	return od
+}
+
+// Ejected reports whether a URL is currently ejected. URLs whose ejection
+// period has passed are returned to the pool.
+func (od *OutlierDetector) Ejected(url string) bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	host, ok := od.hosts[url]
+	if !ok || !host.ejected {
+		return false
+	}
+
+	if time.Now().Before(host.ejectedUntil) {
+		return true
+	}
+
+	host.ejected = false
+	host.consecutive = 0
+	host.returnedAt = time.Now()
+	od.publish()
+
+	od.logger.Info("Upstream URL returned from ejection", map[string]interface{}{
+		"upstream":  od.upstream,
+		"url":       url,
+		"ejections": host.ejections,
+	})
+
+	return false
+}
+
+// Record records the outcome of a live request to a URL. Connection errors,
+// timeouts and 5xx responses count as failures.
+func (od *OutlierDetector) Record(url string, failure bool) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	host, ok := od.hosts[url]
+	if !ok || host.ejected {
+		return
+	}
+
+	if !failure {
+		host.consecutive = 0
+		return
+	}
+
+	host.consecutive++
+	if host.consecutive < od.cfg.ConsecutiveErrors {
+		return
+	}
+
+	if od.ejectedCount() >= od.maxEjected() {
+		od.logger.Warn("Upstream URL not ejected, maximum ejection percentage reached", map[string]interface{}{
+			"upstream":           od.upstream,
+			"url":                url,
+			"consecutive_errors": host.consecutive,
+		})
+		return
+	}
+
+	// Forget past ejections once a URL has stayed healthy long enough
+	if !host.returnedAt.IsZero() && time.Since(host.returnedAt) > od.cfg.MaxEjectionTime {
+		host.ejections = 0
+	}
+
+	host.ejections++
+	duration := od.cfg.BaseEjectionTime * time.Duration(host.ejections)
+	if od.cfg.MaxEjectionTime > 0 && duration > od.cfg.MaxEjectionTime {
+		duration = od.cfg.MaxEjectionTime
+	}
+
+	host.ejected = true
+	host.ejectedUntil = time.Now().Add(duration)
+	od.publish()
+	metrics.OutlierEjections.WithLabelValues(od.upstream, url).Inc()
+
+	od.logger.Warn("Upstream URL ejected", map[string]interface{}{
+		"upstream":           od.upstream,
+		"url":                url,
+		"consecutive_errors": host.consecutive,
+		"ejections":          host.ejections,
+		"duration":           duration.String(),
+	})
+}
+
+// maxEjected returns how many URLs may be ejected at once. At least one URL
+// may be ejected from a pool of two or more, but never the whole pool.
+func (od *OutlierDetector) maxEjected() int {
+	total := len(od.hosts)
+	limit := total * od.cfg.MaxEjectionPercent / 100
+	if limit < 1 && od.cfg.MaxEjectionPercent > 0 {
+		limit = 1
+	}
+	if limit > total-1 {
+		limit = total - 1
+	}
+	return limit
+}
+
+// ejectedCount returns the number of URLs whose ejection period has not
+// passed yet. The caller must hold mu.
+func (od *OutlierDetector) ejectedCount() int {
+	now := time.Now()
+	count := 0
+	for _, host := range od.hosts {
+		if host.ejected && now.Before(host.ejectedUntil) {
+			count++
+		}
+	}
+	return count
+}
+
+// publish exports the number of ejected URLs. The caller must hold mu.
+func (od *OutlierDetector) publish() {
+	metrics.OutlierEjectedHosts.WithLabelValues(od.upstream).Set(float64(od.ejectedCount()))
+}
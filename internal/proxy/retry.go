@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/config"
+)
+
+// retryBudgetWindow is the window over which the retry budget is computed,
+// in one-second buckets
+const retryBudgetWindow = 10
+
+// RetryBudget limits the number of retries relative to the number of
+// requests, so that retries cannot amplify an outage
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+	buckets      [retryBudgetWindow]budgetBucket
+	mu           sync.Mutex
+}
+
+// budgetBucket counts requests and retries within one second
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewRetryBudget creates a retry budget from its configuration
+func NewRetryBudget(cfg config.RetryBudgetConfig) *RetryBudget {
+	return &RetryBudget{
+		ratio:        cfg.Ratio,
+		minPerSecond: cfg.MinRetriesPerSecond,
+	}
+}
+
+// RecordRequest records an original, non-retry request
+func (b *RetryBudget) RecordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// TryRetry reports whether a retry fits in the budget, and if so records it
+func (b *RetryBudget) TryRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	oldest := now.Unix() - retryBudgetWindow
+
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.second > oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowed := int(b.ratio*float64(requests)) + b.minPerSecond*retryBudgetWindow
+	if retries >= allowed {
+		return false
+	}
+
+	b.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket for the given time, resetting it if it holds
+// counts from an earlier window
+func (b *RetryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%retryBudgetWindow]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+// retryPolicy decides whether and when a failed attempt is retried
+type retryPolicy struct {
+	maxAttempts   int
+	retryOn       map[int]bool
+	perTryTimeout time.Duration
+	backoffBase   time.Duration
+	backoffMax    time.Duration
+}
+
+// newRetryPolicy creates a retry policy from its configuration
+func newRetryPolicy(cfg config.RetryConfig) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts:   cfg.MaxAttempts,
+		retryOn:       make(map[int]bool, len(cfg.RetryOn)),
+		perTryTimeout: cfg.PerTryTimeout,
+		backoffBase:   cfg.BackoffBase,
+		backoffMax:    cfg.BackoffMax,
+	}
+	if policy.maxAttempts < 1 {
+		policy.maxAttempts = 1
+	}
+	for _, code := range cfg.RetryOn {
+		policy.retryOn[code] = true
+	}
+	return policy
+}
+
+// enabled reports whether the policy allows any retries
+func (p retryPolicy) enabled() bool {
+	return p.maxAttempts > 1
+}
+
+// backoff waits before the given retry (starting at 1) using exponential
+// backoff with full jitter. It returns false if ctx is done first.
+func (p retryPolicy) backoff(ctx context.Context, retry int) bool {
+	delay := p.backoffBase << (retry - 1)
+	if delay <= 0 || (p.backoffMax > 0 && delay > p.backoffMax) {
+		delay = p.backoffMax
+	}
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(delay) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isRetryable reports whether a request may be sent more than once: its
+// method must be idempotent or it must carry an Idempotency-Key header
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// isHedgeable reports whether a request may be hedged. Hedged attempts run
+// concurrently, so unlike retries this is limited to safe methods: two
+// concurrent PUTs or keyed POSTs could both take effect.
+func isHedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads a request body of up to limit bytes into memory so it can
+// be replayed. If the body is larger, ok is false and rest returns the bytes
+// already read followed by the remainder of the body.
+func bufferBody(body io.ReadCloser, limit int) (data []byte, rest io.ReadCloser, ok bool, err error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil, true, nil
+	}
+
+	data, err = io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if len(data) > limit {
+		rest = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		return nil, rest, false, nil
+	}
+
+	body.Close()
+	return data, nil, true, nil
+}
@@ -1,15 +1,22 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"ai-api-gateway/internal/config"
 	"ai-api-gateway/internal/metrics"
+	"ai-api-gateway/internal/response"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,10 +24,18 @@ import (
 // Router handles request routing to upstream services
 type Router struct {
 	upstreams         map[string]*Upstream
+	routes            []*Route
 	config            *config.ProxyConfig
 	client            *http.Client
 	connTracker       *ConnectionTracker
 	weightedBalancers map[string]*WeightedRoundRobin
+	hashRings         map[string]*HashRing
+	latency           *LatencyTracker // nil unless balancing on latency
+	trustedProxies    []*net.IPNet
+	retryBudget       *RetryBudget
+	mirrors           *mirrorQueue // nil unless a route mirrors requests
+	coalescer         *coalescer   // nil unless coalescing is enabled
+	logger            *config.Logger
 }
 
 // Upstream represents an upstream service
@@ -30,16 +45,32 @@ type Upstream struct {
 	Weights []int
 	Current int
 	Health  *HealthChecker
+	Retry   retryPolicy
+	Hedge   hedgePolicy
+	// Timeouts applies to requests unless their route overrides it
+	Timeouts config.TimeoutConfig
+	// Headers rewrites the headers of requests and responses
+	Headers headerPolicy
+	// Split assigns requests to subsets of the URLs, or is nil if the
+	// upstream has no subsets
+	Split *subsetSplit
+	// Breakers holds a circuit breaker per URL, or nil if disabled
+	Breakers map[string]*CircuitBreaker
+	// Outliers ejects failing URLs, or is nil if disabled
+	Outliers *OutlierDetector
+	client   *http.Client // speaks the upstream's protocol
+	mu       sync.Mutex   // guards Current
 }
 
 // NewRouter creates a new router
-func NewRouter(cfg *config.ProxyConfig) *Router {
+func NewRouter(cfg *config.ProxyConfig, logger *config.Logger) (*Router, error) {
 	transport := &http.Transport{
 		MaxIdleConns:    cfg.MaxIdleConns,
 		IdleConnTimeout: cfg.IdleConnTimeout,
 	}
+	// Timeouts are applied per attempt, so that streamed responses are not
+	// cut off by a total timeout
 	client := &http.Client{
-		Timeout:   cfg.Timeout,
 		Transport: transport,
 	}
 
@@ -49,17 +80,42 @@ func NewRouter(cfg *config.ProxyConfig) *Router {
 		client:            client,
 		connTracker:       NewConnectionTracker(),
 		weightedBalancers: make(map[string]*WeightedRoundRobin),
+		hashRings:         make(map[string]*HashRing),
+		retryBudget:       NewRetryBudget(cfg.RetryBudget),
+		coalescer:         newCoalescer(cfg.Coalesce),
+		logger:            logger,
+	}
+	if cfg.LoadBalancer == "p2c_ewma" {
+		router.latency = NewLatencyTracker()
 	}
 
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	router.trustedProxies = trustedProxies
+
 	// Initialize upstreams from config
 	for name, upstreamCfg := range cfg.Upstreams {
 		upstream := &Upstream{
-			Name:    name,
-			URLs:    upstreamCfg.URLs,
-			Weights: make([]int, len(upstreamCfg.URLs)),
-			Current: 0,
+			Name:     name,
+			URLs:     upstreamCfg.URLs,
+			Weights:  make([]int, 0, len(upstreamCfg.URLs)),
+			Current:  0,
+			Retry:    newRetryPolicy(upstreamCfg.Retry),
+			Hedge:    newHedgePolicy(upstreamCfg.Hedge),
+			Timeouts: upstreamCfg.Timeouts,
+			Split:    newSubsetSplit(upstreamCfg),
+			client:   newUpstreamClient(upstreamCfg.Protocol, cfg, client),
 		}
 
+		headers, err := newHeaderPolicy(upstreamCfg.Headers)
+		if err != nil {
+			router.Close()
+			return nil, fmt.Errorf("upstream %q: %w", name, err)
+		}
+		upstream.Headers = headers
+
 		// Initialize weights (default to 1 if not specified)
 		for range upstreamCfg.URLs {
 			weight := upstreamCfg.Weight
@@ -74,6 +130,24 @@ func NewRouter(cfg *config.ProxyConfig) *Router {
 			router.weightedBalancers[name] = NewWeightedRoundRobin(upstream.URLs, upstream.Weights)
 		}
 
+		// Initialize hash ring if using consistent hashing
+		if cfg.LoadBalancer == "consistent_hash" {
+			router.hashRings[name] = NewHashRing(upstream.URLs, upstream.Weights, cfg.ConsistentHash.VirtualNodes)
+		}
+
+		// Initialize circuit breakers if configured
+		if upstreamCfg.CircuitBreaker.Enabled() {
+			upstream.Breakers = make(map[string]*CircuitBreaker, len(upstream.URLs))
+			for _, u := range upstream.URLs {
+				upstream.Breakers[u] = NewCircuitBreaker(name, u, upstreamCfg.CircuitBreaker)
+			}
+		}
+
+		// Initialize outlier detection if configured
+		if upstreamCfg.OutlierDetection.ConsecutiveErrors > 0 {
+			upstream.Outliers = NewOutlierDetector(name, upstream.URLs, upstreamCfg.OutlierDetection, logger)
+		}
+
 		// Initialize health checker if configured
 		if upstreamCfg.HealthCheck.Path != "" {
 			upstream.Health = NewHealthChecker(upstream, upstreamCfg.HealthCheck)
@@ -83,49 +157,390 @@ func NewRouter(cfg *config.ProxyConfig) *Router {
 		router.upstreams[name] = upstream
 	}
 
-	return router
+	// Initialize route table from config
+	for i, routeCfg := range cfg.Routes {
+		route, err := NewRoute(routeCfg, i)
+		if err != nil {
+			router.Close()
+			return nil, err
+		}
+		router.routes = append(router.routes, route)
+		if routeCfg.Mirror.Upstream != "" && router.mirrors == nil && cfg.Mirror.Concurrency > 0 {
+			router.mirrors = newMirrorQueue(cfg.Mirror, router.sendMirror)
+		}
+	}
+
+	return router, nil
 }
 
-// Proxy proxies a request to an upstream service
+// Close stops the router's health checkers and closes idle upstream
+// connections. Requests already in flight are not interrupted.
+func (r *Router) Close() {
+	for _, upstream := range r.upstreams {
+		if upstream.Health != nil {
+			upstream.Health.Stop()
+		}
+		upstream.client.CloseIdleConnections()
+	}
+	if r.mirrors != nil {
+		r.mirrors.close()
+	}
+	r.client.CloseIdleConnections()
+}
+
+// HasRoutes reports whether a route table is configured
+func (r *Router) HasRoutes() bool {
+	return len(r.routes) > 0
+}
+
+// Match returns the first route matching the request
+func (r *Router) Match(req *http.Request) (*Route, bool) {
+	for _, route := range r.routes {
+		if route.Matches(req) {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// Context keys of the route and subset chosen by Resolve
+const (
+	resolvedRouteKey  = "proxy_route"
+	resolvedSubsetKey = "proxy_subset"
+)
+
+// resolvedSubset is the subset chosen for a request to an upstream
+type resolvedSubset struct {
+	upstream string
+	subset   *subset
+}
+
+// Resolve chooses the route, upstream and subset of a request ahead of the
+// handlers that depend on them, such as the response cache, and sets their
+// names as the "route", "upstream" and "upstream_subset" context values.
+// Handle and Proxy then use the same choice. Requests that match no route or
+// service are left for Handle and Proxy to reject.
+func (r *Router) Resolve(c *gin.Context) {
+	var upstreamName string
+	if r.HasRoutes() {
+		cleanRequestPath(c.Request)
+		route, ok := r.Match(c.Request)
+		if !ok {
+			return
+		}
+		c.Set(resolvedRouteKey, route)
+		c.Set("route", route.Name)
+		upstreamName = route.Upstream
+	} else {
+		service, _, err := ParseServicePath(c.Param("path"))
+		if err != nil {
+			return
+		}
+		upstreamName = service
+	}
+
+	upstream, ok := r.upstreams[upstreamName]
+	if !ok {
+		return
+	}
+	c.Set("upstream", upstream.Name)
+	if upstream.Split != nil {
+		c.Set("upstream_subset", r.chooseSubset(c, upstream).name)
+	}
+}
+
+// chooseSubset returns the subset of upstream a request is sent to, choosing
+// it on first use
+func (r *Router) chooseSubset(c *gin.Context, upstream *Upstream) *subset {
+	if value, ok := c.Get(resolvedSubsetKey); ok {
+		if resolved := value.(resolvedSubset); resolved.upstream == upstream.Name {
+			return resolved.subset
+		}
+	}
+
+	chosen := upstream.Split.choose(c.Request, c.GetString("user_id"))
+	c.Set(resolvedSubsetKey, resolvedSubset{upstream: upstream.Name, subset: chosen})
+	return chosen
+}
+
+// matchRoute returns the route chosen by Resolve, or else the first route
+// matching the request
+func (r *Router) matchRoute(c *gin.Context) (*Route, bool) {
+	if value, ok := c.Get(resolvedRouteKey); ok {
+		return value.(*Route), true
+	}
+	return r.Match(c.Request)
+}
+
+// Handle proxies a request to the upstream of the first matching route
+func (r *Router) Handle(c *gin.Context) {
+	// Route, rewrite and forward the cleaned path
+	cleanRequestPath(c.Request)
+
+	route, ok := r.matchRoute(c)
+	if !ok {
+		response.Error(c, http.StatusNotFound, "No route matches the request")
+		return
+	}
+
+	path := route.UpstreamPath(c.Request.URL.Path)
+	rawQuery := route.UpstreamQuery(c.Request.URL.RawQuery)
+	r.mirror(c, route, path, rawQuery)
+	r.proxy(c, route.Upstream, path, rawQuery, route)
+}
+
+// Proxy proxies a request to an upstream service, forwarding the client's
+// query string unchanged
 func (r *Router) Proxy(c *gin.Context, serviceName, path string) {
+	r.proxy(c, serviceName, path, c.Request.URL.RawQuery, nil)
+}
+
+// proxy proxies a request to an upstream service with the given path and raw
+// query. The timeouts and header rules of the route, if any, apply on top of
+// those of the upstream.
+func (r *Router) proxy(c *gin.Context, serviceName, path, rawQuery string, route *Route) {
 	upstream, ok := r.upstreams[serviceName]
 	if !ok {
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error":     "Bad Gateway",
-			"message":   fmt.Sprintf("Upstream service '%s' not found", serviceName),
-			"code":      http.StatusBadGateway,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
+		response.Error(c, http.StatusBadGateway, fmt.Sprintf("Upstream service '%s' not found", serviceName))
 		return
 	}
 
-	// Select upstream URL based on load balancing strategy
-	upstreamURL := r.selectUpstream(upstream)
-	if upstreamURL == "" {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error":     "Service Unavailable",
-			"message":   "No healthy upstream available",
-			"code":      http.StatusServiceUnavailable,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
+	timeouts := upstream.Timeouts
+	headers := headerPolicies{upstream.Headers}
+	if route != nil {
+		timeouts = timeouts.Override(route.timeouts)
+		headers = append(headers, route.rewrites)
+	}
+	cancel := applyTimeouts(c, timeouts)
+	defer cancel()
+
+	// Requests are coalesced on the headers the client sent, as the rewrites
+	// may remove the headers that tell users apart
+	var clientHeader http.Header
+	coalescing := r.coalescer != nil && coalescible(c.Request)
+	if coalescing {
+		clientHeader = c.Request.Header.Clone()
+	}
+
+	// Rewrite the client request, so that every attempt forwards the
+	// rewritten headers
+	r.setForwardingHeaders(c, c.Request.Header)
+	headers.rewriteRequest(c, c.Request.Header)
+
+	// WebSocket handshakes are sent once and then spliced
+	if isWebSocketUpgrade(c.Request) {
+		r.proxyWebSocket(c, upstream, path, rawQuery, headers)
 		return
 	}
 
-	// Build target URL
-	targetURL := strings.TrimSuffix(upstreamURL, "/") + "/" + strings.TrimPrefix(path, "/")
+	// Identical requests in flight at the same time share one response
+	if coalescing {
+		r.coalesce(c, upstream, path, rawQuery, headers, clientHeader)
+		return
+	}
 
-	// Create request
-	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, targetURL, c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":     "Internal Server Error",
-			"message":   "Failed to create upstream request",
-			"code":      http.StatusInternalServerError,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
+	r.forward(c, upstream, path, rawQuery, headers)
+}
+
+// forward sends a request to an upstream and writes the response, retrying
+// failed attempts on other URLs as the upstream's retry policy allows and
+// hedging slow attempts as its hedge policy allows
+func (r *Router) forward(c *gin.Context, upstream *Upstream, path, rawQuery string, headers headerPolicies) {
+	sel := r.newSelection(c, upstream)
+
+	// Buffer the body of requests that may be retried or hedged so it can be
+	// replayed. Bodies too large to buffer are streamed and the request is
+	// sent only once.
+	policy := upstream.Retry
+	hedgeable := upstream.Hedge.enabled() && isHedgeable(c.Request)
+	replayable := (policy.enabled() && isRetryable(c.Request)) || hedgeable
+	var body []byte
+	if replayable {
+		data, rest, ok, err := bufferBody(c.Request.Body, r.config.MaxBufferedBodySize)
+		if err != nil {
+			response.Error(c, http.StatusBadRequest, "Failed to read request body")
+			return
+		}
+		if ok {
+			body = data
+		} else {
+			c.Request.Body = rest
+			replayable = false
+		}
+	}
+	retryable := replayable && policy.enabled()
+
+	r.retryBudget.RecordRequest()
+
+	for attempt := 1; ; attempt++ {
+		// Select upstream URL based on load balancing strategy, avoiding
+		// URLs that already failed this request
+		upstreamURL := r.selectUpstream(upstream, sel)
+		if upstreamURL == "" {
+			writeNoUpstream(c, upstream)
+			return
+		}
+		sel.tried[upstreamURL] = true
+
+		var at *upstreamAttempt
+		var err error
+		if replayable && hedgeable {
+			at, err = r.hedgedRoundTrip(c, upstream, upstreamURL, sel, path, rawQuery, body)
+		} else {
+			at, err = r.roundTrip(c, upstream, upstreamURL, path, rawQuery, body, replayable, false)
+		}
+		resp := at.resp
+		upstream.recordOutcome(at.url, resp, err, c.Request.Context().Err() != nil)
+		if err == nil && !policy.retryOn[resp.StatusCode] {
+			r.writeResponse(c, at, headers)
+			at.release()
+			return
+		}
+
+		// Retry transport errors and retryable statuses, unless the client
+		// went away or the attempts or the retry budget are exhausted
+		canRetry := retryable && attempt < policy.maxAttempts && c.Request.Context().Err() == nil
+		if canRetry && !r.retryBudget.TryRetry() {
+			metrics.UpstreamRetryBudgetExhausted.WithLabelValues(upstream.Name).Inc()
+			canRetry = false
+		}
+
+		if !canRetry {
+			if err == nil {
+				r.writeResponse(c, at, headers)
+			} else {
+				writeUpstreamError(c, err)
+			}
+			at.release()
+			return
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		at.release()
+
+		metrics.UpstreamRetries.WithLabelValues(upstream.Name).Inc()
+		if !policy.backoff(c.Request.Context(), attempt) {
+			// Answer the client unless it went away
+			if cause := context.Cause(c.Request.Context()); errors.Is(cause, errUpstreamTimeout) {
+				writeUpstreamError(c, cause)
+			}
+			return
+		}
+	}
+}
+
+// writeNoUpstream responds to the client when no URL of the upstream can take
+// the request
+func writeNoUpstream(c *gin.Context, upstream *Upstream) {
+	message := "No healthy upstream available"
+	if upstream.allCircuitsOpen() {
+		message = "All upstream circuits are open"
+	}
+
+	response.Error(c, http.StatusServiceUnavailable, message)
+}
+
+// writeUpstreamError responds to the client after an attempt failed to get a
+// response from the upstream
+func writeUpstreamError(c *gin.Context, err error) {
+	if errors.Is(err, errUpstreamTimeout) {
+		response.Error(c, http.StatusGatewayTimeout, err.Error())
 		return
 	}
 
+	response.Error(c, http.StatusBadGateway, fmt.Sprintf("Failed to connect to upstream: %v", err))
+}
+
+// errUpstreamTimeout is the cause of attempts cancelled because the upstream
+// took too long to respond
+var errUpstreamTimeout = errors.New("upstream timed out")
+
+// errStreamIdle is the cause of streams cancelled because the upstream sent
+// nothing for the stream idle timeout
+var errStreamIdle = errors.New("upstream stream idle")
+
+// upstreamAttempt is one request sent to an upstream URL
+type upstreamAttempt struct {
+	upstream *Upstream
+	url      string
+	start    time.Time
+	resp     *http.Response
+	cancel   context.CancelCauseFunc
+	timeout  *time.Timer // cancels the attempt when the timeout expires
+	done     []func()
+}
+
+// release frees the resources held by the attempt. It must be called once the
+// response has been consumed.
+func (a *upstreamAttempt) release() {
+	if a.timeout != nil {
+		a.timeout.Stop()
+	}
+	a.cancel(nil)
+	for _, done := range a.done {
+		done()
+	}
+}
+
+// roundTrip sends one attempt of the request to upstreamURL. The returned
+// attempt must be released, even when an error is returned.
+//
+// The attempt times out after the upstream's per-try timeout, or the proxy
+// timeout if none is set. The timeout covers the whole response unless the
+// response is streamed, in which case it only covers the response headers.
+func (r *Router) roundTrip(c *gin.Context, upstream *Upstream, upstreamURL, path, rawQuery string, body []byte, replayable, hedged bool) (*upstreamAttempt, error) {
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	at := &upstreamAttempt{upstream: upstream, url: upstreamURL, cancel: cancel}
+
+	if timeouts, ok := ctx.Value(timeoutsKey{}).(config.TimeoutConfig); ok {
+		var stop func()
+		ctx, stop = withPhaseTimeouts(ctx, timeouts, cancel)
+		at.done = append(at.done, stop)
+	}
+
+	timeout := r.config.Timeout
+	if upstream.Retry.perTryTimeout > 0 {
+		timeout = upstream.Retry.perTryTimeout
+	}
+	if timeout > 0 {
+		at.timeout = time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("%w after %s", errUpstreamTimeout, timeout))
+		})
+	}
+
+	// Build target URL, appending the path to any base path of the upstream
+	targetURL, err := url.Parse(upstreamURL)
+	if err != nil {
+		return at, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	targetURL.Path = joinPath(targetURL.Path, path)
+	targetURL.RawPath = ""
+	targetURL.RawQuery = rawQuery
+
+	// Create request, replaying the buffered body if there is one
+	reqBody := c.Request.Body
+	if replayable {
+		reqBody = http.NoBody
+		if len(body) > 0 {
+			reqBody = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Request.Method, targetURL.String(), reqBody)
+	if err != nil {
+		return at, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+	if replayable {
+		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	} else {
+		req.ContentLength = c.Request.ContentLength
+	}
+
 	// Copy headers
 	for key, values := range c.Request.Header {
 		for _, value := range values {
@@ -133,129 +548,433 @@ func (r *Router) Proxy(c *gin.Context, serviceName, path string) {
 		}
 	}
 
-	// Remove hop-by-hop headers
-	req.Header.Del("Connection")
-	req.Header.Del("Keep-Alive")
-	req.Header.Del("Proxy-Authenticate")
-	req.Header.Del("Proxy-Authorization")
-	req.Header.Del("Te")
-	req.Header.Del("Trailers")
-	req.Header.Del("Transfer-Encoding")
-	req.Header.Del("Upgrade")
+	removeHopHeaders(req.Header)
+	propagateDeadline(req)
+
+	// Te is hop-by-hop, but gRPC requires "Te: trailers" end to end
+	if headerHasToken(c.Request.Header, "Te", "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+
+	// Keep the upgrade of WebSocket handshakes
+	if isWebSocketUpgrade(c.Request) {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+	}
 
-	// Track connection for least connections strategy
-	if r.config.LoadBalancer == "least_connections" {
+	// Track in-flight requests for the strategies that balance on them
+	if r.config.LoadBalancer == "least_connections" || r.config.LoadBalancer == "p2c_ewma" {
 		r.connTracker.Increment(upstreamURL)
-		defer r.connTracker.Decrement(upstreamURL)
+		at.done = append(at.done, func() {
+			r.connTracker.Decrement(upstreamURL)
+		})
 	}
 
 	// Record start time for metrics
-	start := time.Now()
+	at.start = time.Now()
 
-	// Make request
-	resp, err := r.client.Do(req)
+	// Make request. WebSocket handshakes always use HTTP/1.1.
+	client := upstream.client
+	if isWebSocketUpgrade(c.Request) {
+		client = r.client
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		metrics.UpstreamRequests.WithLabelValues(serviceName, "error").Inc()
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error":     "Bad Gateway",
-			"message":   fmt.Sprintf("Failed to connect to upstream: %v", err),
-			"code":      http.StatusBadGateway,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
-		return
+		metrics.UpstreamRequests.WithLabelValues(upstream.Name, "error", strconv.FormatBool(hedged)).Inc()
+		r.observeLatency(upstream, upstreamURL, time.Since(at.start), true, c.Request.Context().Err() != nil)
+		if cause := context.Cause(ctx); errors.Is(cause, errUpstreamTimeout) {
+			return at, cause
+		}
+		return at, err
 	}
-	defer resp.Body.Close()
+	at.resp = resp
 
 	// Record metrics
-	duration := time.Since(start).Seconds()
+	latency := time.Since(at.start)
 	statusCode := fmt.Sprintf("%d", resp.StatusCode)
-	metrics.UpstreamRequests.WithLabelValues(serviceName, statusCode).Inc()
-	metrics.UpstreamRequestDuration.WithLabelValues(serviceName, statusCode).Observe(duration)
+	metrics.UpstreamRequests.WithLabelValues(upstream.Name, statusCode, strconv.FormatBool(hedged)).Inc()
+	metrics.UpstreamRequestDuration.WithLabelValues(upstream.Name, statusCode).Observe(latency.Seconds())
+	upstream.Hedge.observe(latency)
+	r.observeLatency(upstream, upstreamURL, latency, resp.StatusCode >= http.StatusInternalServerError, false)
+
+	return at, nil
+}
+
+// observeLatency feeds the latency of an attempt to the latency-aware load
+// balancer. Failures count as taking the whole proxy timeout, so a URL that
+// fails fast is not mistaken for a fast one. Attempts cancelled by the client
+// or a hedge say nothing about the URL and are ignored.
+func (r *Router) observeLatency(upstream *Upstream, upstreamURL string, latency time.Duration, failed, cancelled bool) {
+	if r.latency == nil || cancelled {
+		return
+	}
+	if failed && latency < r.config.Timeout {
+		latency = r.config.Timeout
+	}
+	r.latency.Observe(upstream.Name, upstreamURL, latency)
+}
+
+// removeHopHeaders removes the hop-by-hop headers of a request that is
+// forwarded upstream
+func removeHopHeaders(header http.Header) {
+	header.Del("Connection")
+	header.Del("Keep-Alive")
+	header.Del("Proxy-Authenticate")
+	header.Del("Proxy-Authorization")
+	header.Del("Te")
+	header.Del("Trailers")
+	header.Del("Transfer-Encoding")
+	header.Del("Upgrade")
+}
+
+// writeResponse copies an upstream response to the client. Streamed
+// responses are flushed as they arrive.
+func (r *Router) writeResponse(c *gin.Context, at *upstreamAttempt, headers headerPolicies) {
+	resp := at.resp
+	defer resp.Body.Close()
 
 	// Copy response headers
+	r.rewriteResponseHeaders(c, resp.Header, headers)
 	for key, values := range resp.Header {
 		for _, value := range values {
-			c.Header(key, value)
+			c.Writer.Header().Add(key, value)
 		}
 	}
 
 	// Set status code
 	c.Status(resp.StatusCode)
 
-	// Copy response body
-	io.Copy(c.Writer, resp.Body)
+	body := &firstByteReader{Reader: resp.Body, observe: func() {
+		metrics.UpstreamTimeToFirstByte.WithLabelValues(at.upstream.Name).Observe(time.Since(at.start).Seconds())
+	}}
+
+	if isStreaming(resp) {
+		r.stream(c, at, body)
+	} else {
+		// Copy response body
+		io.Copy(c.Writer, body)
+	}
+
+	copyTrailers(c, resp)
+	if response.IsGRPC(c.Request) {
+		recordGRPC(at)
+	}
 }
 
-// selectUpstream selects an upstream URL based on load balancing strategy
-func (r *Router) selectUpstream(upstream *Upstream) string {
-	if len(upstream.URLs) == 0 {
-		return ""
+// rewriteResponseHeaders removes the hidden headers from an upstream response,
+// such as a Server header revealing the upstream's software, then applies the
+// response header rules
+func (r *Router) rewriteResponseHeaders(c *gin.Context, header http.Header, headers headerPolicies) {
+	for _, name := range r.config.HideHeaders {
+		header.Del(name)
 	}
+	headers.rewriteResponse(c, header)
+}
 
-	switch r.config.LoadBalancer {
-	case "round_robin":
-		return r.roundRobin(upstream)
-	case "least_connections":
-		return r.leastConnections(upstream)
-	case "weighted":
-		return r.weighted(upstream)
-	default:
-		return r.roundRobin(upstream)
+// stream copies a streamed response body to the client, flushing every chunk
+// as soon as it is read. Instead of a total timeout, the stream is cancelled
+// when the upstream sends nothing for the stream idle timeout. A client that
+// goes away cancels the upstream request.
+func (r *Router) stream(c *gin.Context, at *upstreamAttempt, body io.Reader) {
+	// The response timeout only applies to the headers of a stream
+	if at.timeout != nil {
+		at.timeout.Stop()
+	}
+
+	idleTimeout := r.config.StreamIdleTimeout
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			at.cancel(errStreamIdle)
+		})
+		defer idle.Stop()
+	}
+
+	// Lift the server write timeout for the stream, setting a per-write
+	// deadline instead. Writers that do not support deadlines are left as is.
+	rc := http.NewResponseController(c.Writer)
+	rc.SetWriteDeadline(time.Time{})
+
+	// Send the headers right away so clients know the stream has started
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if idle != nil {
+				idle.Reset(idleTimeout)
+				rc.SetWriteDeadline(time.Now().Add(idleTimeout))
+			}
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				// The client went away; stop reading from the upstream
+				at.cancel(werr)
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			if errors.Is(context.Cause(c.Request.Context()), context.Canceled) {
+				return
+			}
+			if err != io.EOF {
+				r.logger.Warn("Upstream stream ended with an error", map[string]interface{}{
+					"upstream": at.upstream.Name,
+					"url":      at.url,
+					"error":    streamError(at, err).Error(),
+				})
+			}
+			return
+		}
 	}
 }
 
-// roundRobin selects next upstream in round-robin fashion
-func (r *Router) roundRobin(upstream *Upstream) string {
-	if len(upstream.URLs) == 0 {
+// streamError returns the reason a stream was cut short
+func streamError(at *upstreamAttempt, err error) error {
+	if at.resp != nil {
+		if cause := context.Cause(at.resp.Request.Context()); cause != nil {
+			return cause
+		}
+	}
+	return err
+}
+
+// isStreaming reports whether a response is streamed: server-sent events,
+// newline-delimited JSON, gRPC, or a chunked body of unknown length
+func isStreaming(resp *http.Response) bool {
+	switch contentType := mediaType(resp.Header.Get("Content-Type")); {
+	case contentType == "text/event-stream", contentType == "application/x-ndjson", contentType == "application/stream+json":
+		return true
+	case strings.HasPrefix(contentType, "application/grpc"):
+		return true
+	}
+	return resp.ContentLength < 0
+}
+
+// mediaType returns the lower-cased media type of a Content-Type header,
+// without parameters
+func mediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// firstByteReader calls observe once, when the first byte is read or the body
+// turns out to be empty
+type firstByteReader struct {
+	io.Reader
+	observe func()
+	seen    bool
+}
+
+// Read reads from the underlying reader
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if !f.seen && (n > 0 || err != nil) {
+		f.seen = true
+		f.observe()
+	}
+	return n, err
+}
+
+// selection holds the request-specific inputs for choosing upstream URLs
+type selection struct {
+	subset  []string        // URLs of the subset chosen for the request, or nil
+	hashKey string          // consistent hashing key, empty if there is none
+	tried   map[string]bool // URLs already tried, avoided while others are left
+}
+
+// newSelection prepares the selection of upstream URLs for a request
+func (r *Router) newSelection(c *gin.Context, upstream *Upstream) *selection {
+	sel := &selection{tried: make(map[string]bool)}
+
+	if upstream.Split != nil {
+		chosen := r.chooseSubset(c, upstream)
+		metrics.UpstreamSubsetRequests.WithLabelValues(upstream.Name, chosen.name).Inc()
+		sel.subset = chosen.urls
+	}
+
+	if r.config.LoadBalancer == "consistent_hash" {
+		sel.hashKey = r.hashKey(c)
+	}
+
+	return sel
+}
+
+// selectUpstream selects an upstream URL for a request within its subset,
+// falling back to the other URLs of the upstream when none of the subset is
+// available
+func (r *Router) selectUpstream(upstream *Upstream, sel *selection) string {
+	if sel.subset != nil {
+		if selected := r.selectAmong(upstream, sel.subset, sel); selected != "" {
+			return selected
+		}
+	}
+	return r.selectAmong(upstream, upstream.URLs, sel)
+}
+
+// selectAmong selects one of the given URLs of an upstream based on load
+// balancing strategy. URLs whose circuit is open are never selected; URLs
+// already tried are skipped unless no other candidate is left. If the
+// selected URL has a circuit breaker, the request has been admitted by it and
+// its outcome must be recorded.
+func (r *Router) selectAmong(upstream *Upstream, urls []string, sel *selection) string {
+	if urls == nil {
+		urls = upstream.URLs
+	}
+	if len(urls) == 0 {
 		return ""
 	}
 
 	// Filter healthy upstreams if health checker is available
-	healthyURLs := upstream.URLs
+	healthy := urls
 	if upstream.Health != nil {
-		healthyURLs = upstream.Health.GetHealthyURLs()
-		if len(healthyURLs) == 0 {
+		healthyURLs := make(map[string]bool, len(urls))
+		for _, u := range upstream.Health.GetHealthyURLs() {
+			healthyURLs[u] = true
+		}
+		healthy = make([]string, 0, len(urls))
+		for _, u := range urls {
+			if healthyURLs[u] {
+				healthy = append(healthy, u)
+			}
+		}
+		if len(healthy) == 0 {
 			return ""
 		}
 	}
 
-	upstream.Current = (upstream.Current + 1) % len(healthyURLs)
-	return healthyURLs[upstream.Current]
-}
+	// Leave out URLs ejected by outlier detection
+	if upstream.Outliers != nil {
+		available := make([]string, 0, len(healthy))
+		for _, u := range healthy {
+			if !upstream.Outliers.Ejected(u) {
+				available = append(available, u)
+			}
+		}
+		healthy = available
+	}
 
-// leastConnections selects upstream with least connections
-func (r *Router) leastConnections(upstream *Upstream) string {
-	// Filter healthy upstreams if health checker is available
-	healthyURLs := upstream.URLs
-	if upstream.Health != nil {
-		healthyURLs = upstream.Health.GetHealthyURLs()
-		if len(healthyURLs) == 0 {
+	// A half-open circuit may turn away the request once it is selected, so
+	// keep selecting among the remaining URLs
+	rejected := make(map[string]bool)
+	for {
+		candidates := make([]string, 0, len(healthy))
+		for _, u := range healthy {
+			if breaker := upstream.Breakers[u]; !rejected[u] && (breaker == nil || breaker.Available()) {
+				candidates = append(candidates, u)
+			}
+		}
+		if len(candidates) == 0 {
 			return ""
 		}
+
+		selected := r.selectCandidate(upstream, candidates, sel)
+		if breaker := upstream.Breakers[selected]; breaker == nil || breaker.Allow() {
+			return selected
+		}
+		rejected[selected] = true
+	}
+}
+
+// selectCandidate selects one of the candidate URLs based on load balancing
+// strategy, skipping URLs already tried unless no other candidate is left
+func (r *Router) selectCandidate(upstream *Upstream, candidates []string, sel *selection) string {
+	if len(sel.tried) > 0 {
+		remaining := make([]string, 0, len(candidates))
+		for _, u := range candidates {
+			if !sel.tried[u] {
+				remaining = append(remaining, u)
+			}
+		}
+		if len(remaining) > 0 {
+			candidates = remaining
+		}
 	}
 
-	return r.connTracker.GetLeastConnections(healthyURLs)
+	switch r.config.LoadBalancer {
+	case "round_robin":
+		return r.roundRobin(upstream, candidates)
+	case "least_connections":
+		return r.leastConnections(candidates)
+	case "weighted":
+		return r.weighted(upstream, candidates)
+	case "consistent_hash":
+		return r.consistentHash(upstream, candidates, sel.hashKey)
+	case "p2c_ewma":
+		return r.p2cEWMA(candidates)
+	default:
+		return r.roundRobin(upstream, candidates)
+	}
 }
 
-// weighted selects upstream based on weights
-func (r *Router) weighted(upstream *Upstream) string {
-	// Filter healthy upstreams if health checker is available
-	healthyURLs := upstream.URLs
-	if upstream.Health != nil {
-		healthyURLs = upstream.Health.GetHealthyURLs()
-		if len(healthyURLs) == 0 {
-			return ""
+// recordOutcome feeds the outcome of a request to a URL into its circuit
+// breaker and the outlier detector. Requests abandoned by the client say
+// nothing about the URL and are not counted.
+func (u *Upstream) recordOutcome(url string, resp *http.Response, err error, clientGone bool) {
+	breaker := u.Breakers[url]
+	if err != nil && clientGone {
+		if breaker != nil {
+			breaker.Release()
 		}
+		return
 	}
 
-	// Get or create weighted balancer
+	failure := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	if breaker != nil {
+		breaker.Record(!failure)
+	}
+	if u.Outliers != nil {
+		u.Outliers.Record(url, failure)
+	}
+}
+
+// allCircuitsOpen reports whether the upstream has circuit breakers and none
+// of them currently lets requests through
+func (u *Upstream) allCircuitsOpen() bool {
+	if len(u.Breakers) == 0 {
+		return false
+	}
+	for _, breaker := range u.Breakers {
+		if breaker.Available() {
+			return false
+		}
+	}
+	return true
+}
+
+// roundRobin selects next upstream in round-robin fashion
+func (r *Router) roundRobin(upstream *Upstream, urls []string) string {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.Current = (upstream.Current + 1) % len(urls)
+	return urls[upstream.Current]
+}
+
+// leastConnections selects upstream with least connections
+func (r *Router) leastConnections(urls []string) string {
+	return r.connTracker.GetLeastConnections(urls)
+}
+
+// weighted selects upstream based on weights. The balancers are built in
+// NewRouter and only read afterwards, as requests select concurrently.
+func (r *Router) weighted(upstream *Upstream, urls []string) string {
 	balancer, exists := r.weightedBalancers[upstream.Name]
 	if !exists {
-		balancer = NewWeightedRoundRobin(healthyURLs, upstream.Weights)
-		r.weightedBalancers[upstream.Name] = balancer
+		return r.roundRobin(upstream, urls)
 	}
+	return balancer.NextAmong(urls)
+}
 
-	return balancer.Next()
+// consistentHash selects the upstream a request key maps to on the hash ring,
+// or falls back to round robin for requests without a key
+func (r *Router) consistentHash(upstream *Upstream, urls []string, key string) string {
+	ring, exists := r.hashRings[upstream.Name]
+	if !exists || key == "" {
+		return r.roundRobin(upstream, urls)
+	}
+	return ring.Get(key, urls)
 }
 
 // ParseServicePath parses service name and path from request path
@@ -279,8 +998,35 @@ func ParseServicePath(path string) (service, remainingPath string, err error) {
 	return service, remainingPath, nil
 }
 
-// ValidateURL validates an upstream URL
+// ValidateURL validates an upstream URL. Besides being parseable, the URL must
+// use http or https, name a host, carry a valid port if one is given and have
+// no query or fragment, since those would be lost when building target URLs.
 func ValidateURL(urlStr string) error {
-	_, err := url.Parse(urlStr)
-	return err
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", parsed.Scheme)
+	}
+
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("missing host")
+	}
+
+	if port := parsed.Port(); port != "" {
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum <= 0 || portNum > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	} else if strings.HasSuffix(parsed.Host, ":") {
+		return fmt.Errorf("empty port")
+	}
+
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return fmt.Errorf("upstream URL must not contain a query or fragment")
+	}
+
+	return nil
 }
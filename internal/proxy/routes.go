@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"ai-api-gateway/internal/auth"
+	"ai-api-gateway/internal/config"
+)
+
+// Route maps matching requests to a named upstream
+type Route struct {
+	Name          string
+	Upstream      string
+	host          string
+	path          string
+	pathPrefix    string
+	pathRegex     *regexp.Regexp
+	methods       map[string]bool
+	headers       []valueMatcher
+	query         []valueMatcher
+	claims        []valueMatcher
+	stripPrefix   bool
+	prefixRewrite string
+	regexRewrite  *regexp.Regexp
+	substitution  string
+	pathOverride  string
+	queryRewrite  config.QueryRewrite
+	mirror        config.MirrorPolicy
+	timeouts      config.TimeoutConfig
+	rewrites      headerPolicy // rewrites request and response headers
+}
+
+// valueMatcher matches a named request value such as a header
+type valueMatcher struct {
+	name   string
+	value  string
+	regex  *regexp.Regexp
+	absent bool
+}
+
+// NewRoute creates a route from its configuration
+func NewRoute(cfg config.RouteConfig, index int) (*Route, error) {
+	route := &Route{
+		Name:          cfg.DisplayName(index),
+		Upstream:      cfg.Upstream,
+		host:          strings.ToLower(cfg.Match.Host),
+		path:          cfg.Match.Path,
+		pathPrefix:    cfg.Match.PathPrefix,
+		stripPrefix:   cfg.StripPrefix,
+		prefixRewrite: cfg.PrefixRewrite,
+		pathOverride:  cfg.PathOverride,
+		queryRewrite:  cfg.QueryRewrite,
+		mirror:        cfg.Mirror,
+		timeouts:      cfg.Timeouts,
+	}
+
+	if cfg.Match.PathRegex != "" {
+		re, err := regexp.Compile(cfg.Match.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: invalid path regex: %w", route.Name, err)
+		}
+		route.pathRegex = re
+	}
+
+	if cfg.RegexRewrite.IsSet() {
+		route.regexRewrite = route.pathRegex
+		if cfg.RegexRewrite.Pattern != "" {
+			re, err := regexp.Compile(cfg.RegexRewrite.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: invalid rewrite regex: %w", route.Name, err)
+			}
+			route.regexRewrite = re
+		}
+		if route.regexRewrite == nil {
+			return nil, fmt.Errorf("route %q: regex rewrite requires a pattern", route.Name)
+		}
+		route.substitution = cfg.RegexRewrite.Substitution
+	}
+
+	var err error
+	if route.headers, err = newValueMatchers(cfg.Match.Headers); err != nil {
+		return nil, fmt.Errorf("route %q: header match: %w", route.Name, err)
+	}
+	if route.query, err = newValueMatchers(cfg.Match.Query); err != nil {
+		return nil, fmt.Errorf("route %q: query match: %w", route.Name, err)
+	}
+	if route.claims, err = newValueMatchers(cfg.Match.Claims); err != nil {
+		return nil, fmt.Errorf("route %q: claim match: %w", route.Name, err)
+	}
+	if route.rewrites, err = newHeaderPolicy(cfg.Headers); err != nil {
+		return nil, fmt.Errorf("route %q: headers: %w", route.Name, err)
+	}
+
+	if len(cfg.Match.Methods) > 0 {
+		route.methods = make(map[string]bool, len(cfg.Match.Methods))
+		for _, method := range cfg.Match.Methods {
+			route.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	return route, nil
+}
+
+// Matches checks if a request meets all of the route's conditions
+func (rt *Route) Matches(req *http.Request) bool {
+	if rt.methods != nil && !rt.methods[req.Method] {
+		return false
+	}
+
+	if rt.host != "" && !matchHost(rt.host, req.Host) {
+		return false
+	}
+
+	path := cleanPath(req.URL.Path)
+	switch {
+	case rt.path != "" && path != rt.path:
+		return false
+	case rt.pathPrefix != "" && !hasPathPrefix(path, rt.pathPrefix):
+		return false
+	case rt.pathRegex != nil && !rt.pathRegex.MatchString(path):
+		return false
+	}
+
+	for _, m := range rt.headers {
+		if !m.matches(req.Header.Values(m.name)) {
+			return false
+		}
+	}
+
+	if len(rt.query) > 0 {
+		query := req.URL.Query()
+		for _, m := range rt.query {
+			if !m.matches(query[m.name]) {
+				return false
+			}
+		}
+	}
+
+	if len(rt.claims) > 0 {
+		claims, _ := auth.GetClaimsFromContext(req.Context())
+		for _, m := range rt.claims {
+			if !m.matches(auth.ClaimValues(claims, m.name)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// UpstreamPath returns the path to forward upstream, applying the route's
+// path override, regex rewrite or prefix stripping or rewriting
+func (rt *Route) UpstreamPath(path string) string {
+	if rt.pathOverride != "" {
+		return rt.pathOverride
+	}
+
+	if rt.regexRewrite != nil {
+		return rt.regexRewrite.ReplaceAllString(path, rt.substitution)
+	}
+
+	if rt.pathPrefix == "" || (!rt.stripPrefix && rt.prefixRewrite == "") {
+		return path
+	}
+
+	remaining := strings.TrimPrefix(path, strings.TrimSuffix(rt.pathPrefix, "/"))
+	replacement := rt.prefixRewrite
+	if rt.stripPrefix {
+		replacement = "/"
+	}
+
+	return joinPath(replacement, remaining)
+}
+
+// UpstreamQuery returns the raw query to forward upstream. Without query
+// rewrites the client's query string is forwarded untouched, keeping its
+// original encoding and parameter order.
+func (rt *Route) UpstreamQuery(rawQuery string) string {
+	if !rt.queryRewrite.IsSet() {
+		return rawQuery
+	}
+
+	// Malformed pairs are dropped, the rest of the query is kept
+	query, _ := url.ParseQuery(rawQuery)
+
+	for from, to := range rt.queryRewrite.Rename {
+		if values, ok := query[from]; ok {
+			delete(query, from)
+			query[to] = values
+		}
+	}
+
+	for _, name := range rt.queryRewrite.Remove {
+		query.Del(name)
+	}
+
+	for name, value := range rt.queryRewrite.Add {
+		query.Set(name, value)
+	}
+
+	return query.Encode()
+}
+
+// newValueMatchers compiles value match configurations
+func newValueMatchers(cfgs []config.ValueMatch) ([]valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		m := valueMatcher{name: cfg.Name, value: cfg.Value, absent: cfg.Absent}
+		if cfg.Regex != "" {
+			re, err := regexp.Compile(cfg.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid regex: %w", cfg.Name, err)
+			}
+			m.regex = re
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// matches checks if any of the given values satisfies the matcher
+func (m valueMatcher) matches(values []string) bool {
+	if m.absent {
+		return len(values) == 0
+	}
+
+	for _, v := range values {
+		switch {
+		case m.regex != nil:
+			if m.regex.MatchString(v) {
+				return true
+			}
+		case m.value != "":
+			if v == m.value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost checks a request host against an exact or wildcard host pattern
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
+
+// hasPathPrefix checks if path starts with prefix on a segment boundary, so
+// that /orders matches /orders and /orders/1 but not /orders-archive
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return path[len(prefix)] == '/'
+}
+
+// cleanPath resolves . and .. segments and repeated slashes in a request path,
+// keeping any trailing slash, so that /api/public/../admin cannot match a
+// route for /api/public
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// cleanRequestPath cleans the path of req in place, so that the upstream
+// cannot resolve dot segments to a path outside the matched route
+func cleanRequestPath(req *http.Request) {
+	if cleaned := cleanPath(req.URL.Path); cleaned != req.URL.Path {
+		req.URL.Path = cleaned
+		req.URL.RawPath = ""
+	}
+}
+
+// joinPath joins two URL paths with exactly one slash between them
+func joinPath(base, path string) string {
+	if path == "" || path == "/" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"ai-api-gateway/internal/config"
+)
+
+// ErrUpstreamNotFound is returned for operations on an unknown upstream
+var ErrUpstreamNotFound = errors.New("upstream not found")
+
+// subset is a named group of URLs of an upstream, such as a canary version
+type subset struct {
+	name       string
+	urls       []string
+	percentage float64
+}
+
+// subsetSplit assigns requests to the subsets of an upstream by percentage.
+// The percentages can be changed at runtime.
+type subsetSplit struct {
+	subsets []*subset
+	sticky  bool
+	canary  string
+	mu      sync.RWMutex // guards the subset percentages
+}
+
+// newSubsetSplit creates the split of an upstream, or returns nil if the
+// upstream has no subsets
+func newSubsetSplit(cfg config.UpstreamConfig) *subsetSplit {
+	if len(cfg.Subsets) == 0 {
+		return nil
+	}
+
+	split := &subsetSplit{
+		sticky: cfg.Split.Sticky,
+		canary: cfg.Split.CanarySubset,
+	}
+	for _, s := range cfg.Subsets {
+		split.subsets = append(split.subsets, &subset{
+			name:       s.Name,
+			urls:       s.URLs,
+			percentage: s.Percentage,
+		})
+	}
+	return split
+}
+
+// choose returns the subset a request is sent to. "X-Canary: always" selects
+// the canary subset. With sticky assignment, a user is always placed at the
+// same point of the split, so users only move when the percentages change.
+func (s *subsetSplit) choose(req *http.Request, userID string) *subset {
+	if strings.EqualFold(req.Header.Get("X-Canary"), "always") {
+		for _, sub := range s.subsets {
+			if sub.name == s.canary {
+				return sub
+			}
+		}
+	}
+
+	var point float64
+	if s.sticky && userID != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(userID))
+		point = float64(hash.Sum32()%10000) / 100
+	} else {
+		point = rand.Float64() * 100
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cumulative := 0.0
+	for _, sub := range s.subsets {
+		cumulative += sub.percentage
+		if point < cumulative {
+			return sub
+		}
+	}
+
+	// Rounding left the point past the end; use the last subset with traffic
+	for i := len(s.subsets) - 1; i > 0; i-- {
+		if s.subsets[i].percentage > 0 {
+			return s.subsets[i]
+		}
+	}
+	return s.subsets[0]
+}
+
+// percentages returns the current percentage of each subset
+func (s *subsetSplit) percentages() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	percentages := make(map[string]float64, len(s.subsets))
+	for _, sub := range s.subsets {
+		percentages[sub.name] = sub.percentage
+	}
+	return percentages
+}
+
+// setPercentages replaces the percentages of the subsets. Subsets left out
+// get no traffic; the percentages must add up to 100.
+func (s *subsetSplit) setPercentages(percentages map[string]float64) error {
+	total := 0.0
+	for name, percentage := range percentages {
+		if !s.has(name) {
+			return fmt.Errorf("unknown subset %q", name)
+		}
+		if percentage < 0 {
+			return fmt.Errorf("percentage of subset %q must not be negative", name)
+		}
+		total += percentage
+	}
+	if math.Abs(total-100) > 0.001 {
+		return fmt.Errorf("percentages must add up to 100, got %g", total)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subsets {
+		sub.percentage = percentages[sub.name]
+	}
+	return nil
+}
+
+// has reports whether the split has a subset with the given name
+func (s *subsetSplit) has(name string) bool {
+	for _, sub := range s.subsets {
+		if sub.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Split returns the current traffic split of an upstream by subset name. It
+// is false if the upstream does not exist or has no subsets.
+func (r *Router) Split(upstreamName string) (map[string]float64, bool) {
+	upstream, ok := r.upstreams[upstreamName]
+	if !ok || upstream.Split == nil {
+		return nil, false
+	}
+	return upstream.Split.percentages(), true
+}
+
+// SetSplit changes the traffic split of an upstream at runtime. The change
+// lasts until the configuration is reloaded.
+func (r *Router) SetSplit(upstreamName string, percentages map[string]float64) error {
+	upstream, ok := r.upstreams[upstreamName]
+	if !ok {
+		return ErrUpstreamNotFound
+	}
+	if upstream.Split == nil {
+		return fmt.Errorf("upstream %q has no subsets", upstreamName)
+	}
+	return upstream.Split.setPercentages(percentages)
+}
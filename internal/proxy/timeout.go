@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeoutHeader lets clients shorten the timeout of a request. Its
+// value is a number of seconds or a duration such as "1.5s".
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// grpcTimeoutHeader carries the deadline of gRPC calls
+const grpcTimeoutHeader = "Grpc-Timeout"
+
+// Timeout phases reported when an attempt is cancelled
+const (
+	phaseConnect        = "connect"
+	phaseTLSHandshake   = "TLS handshake"
+	phaseResponseHeader = "response header"
+)
+
+// timeoutsKey is the request context key of the timeouts of a request
+type timeoutsKey struct{}
+
+// applyTimeouts attaches the timeouts of a request to its context, where its
+// attempts find them. Except for WebSocket handshakes, the total timeout,
+// shortened by any timeout the client asked for, becomes the deadline of the
+// request. The returned function releases the deadline.
+func applyTimeouts(c *gin.Context, timeouts config.TimeoutConfig) context.CancelFunc {
+	ctx := context.WithValue(c.Request.Context(), timeoutsKey{}, timeouts)
+	cancel := context.CancelFunc(func() {})
+
+	if !isWebSocketUpgrade(c.Request) {
+		total := timeouts.Total
+		if requested, ok := clientTimeout(c.Request); ok && (total == 0 || requested < total) {
+			total = requested
+		}
+		if total > 0 {
+			ctx, cancel = context.WithTimeoutCause(ctx, total, fmt.Errorf("%w: request deadline of %s exceeded", errUpstreamTimeout, total))
+		}
+	}
+
+	c.Request = c.Request.WithContext(ctx)
+	return cancel
+}
+
+// clientTimeout returns the shortest timeout the client set with an
+// X-Request-Timeout or grpc-timeout header. Invalid values are ignored.
+func clientTimeout(req *http.Request) (time.Duration, bool) {
+	var timeout time.Duration
+	if d, ok := parseRequestTimeout(req.Header.Get(requestTimeoutHeader)); ok {
+		timeout = d
+	}
+	if d, ok := parseGRPCTimeout(req.Header.Get(grpcTimeoutHeader)); ok && (timeout == 0 || d < timeout) {
+		timeout = d
+	}
+	return timeout, timeout > 0
+}
+
+// parseRequestTimeout parses an X-Request-Timeout value
+func parseRequestTimeout(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		d := time.Duration(seconds * float64(time.Second))
+		return d, d > 0
+	}
+	d, err := time.ParseDuration(value)
+	return d, err == nil && d > 0
+}
+
+// grpcTimeoutUnits maps the units of grpc-timeout values to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout value: up to 8 digits followed by a
+// unit, such as "250m" for 250 milliseconds
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// propagateDeadline replaces the timeout headers of an upstream request with
+// the time left before its deadline, so the upstream can give up when the
+// gateway does. gRPC requests carry grpc-timeout, others X-Request-Timeout.
+func propagateDeadline(req *http.Request) {
+	req.Header.Del(requestTimeoutHeader)
+	req.Header.Del(grpcTimeoutHeader)
+
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Round(time.Millisecond)
+	if remaining <= 0 {
+		return
+	}
+
+	if response.IsGRPC(req) {
+		if ms := remaining.Milliseconds(); ms <= 99999999 {
+			req.Header.Set(grpcTimeoutHeader, strconv.FormatInt(ms, 10)+"m")
+		} else {
+			req.Header.Set(grpcTimeoutHeader, strconv.FormatInt(int64(remaining.Seconds()), 10)+"S")
+		}
+		return
+	}
+	req.Header.Set(requestTimeoutHeader, strconv.FormatFloat(remaining.Seconds(), 'f', -1, 64))
+}
+
+// withPhaseTimeouts returns a context that traces an attempt and cancels it
+// when connecting, the TLS handshake or waiting for the response headers
+// takes longer than its timeout. The returned function stops the timers.
+func withPhaseTimeouts(ctx context.Context, timeouts config.TimeoutConfig, cancel context.CancelCauseFunc) (context.Context, func()) {
+	if timeouts.Connect == 0 && timeouts.TLSHandshake == 0 && timeouts.ResponseHeader == 0 {
+		return ctx, func() {}
+	}
+
+	p := &phaseTimer{
+		cancel: cancel,
+		timers: make(map[string]*time.Timer),
+		done:   make(map[string]bool),
+	}
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			p.start(phaseConnect, timeouts.Connect)
+		},
+		ConnectDone: func(_, _ string, err error) {
+			// Other addresses of the host may still be tried
+			if err == nil {
+				p.stop(phaseConnect)
+			}
+		},
+		TLSHandshakeStart: func() {
+			p.start(phaseTLSHandshake, timeouts.TLSHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			p.stop(phaseTLSHandshake)
+		},
+		// The request may get a connection dialed for another one
+		GotConn: func(httptrace.GotConnInfo) {
+			p.stop(phaseConnect, phaseTLSHandshake)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			p.start(phaseResponseHeader, timeouts.ResponseHeader)
+		},
+		GotFirstResponseByte: func() {
+			p.stop(phaseResponseHeader)
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), func() {
+		p.stop(phaseConnect, phaseTLSHandshake, phaseResponseHeader)
+	}
+}
+
+// phaseTimer cancels an attempt when one of its phases takes too long. A
+// phase is timed once, from its first start to its first stop.
+type phaseTimer struct {
+	mu     sync.Mutex
+	cancel context.CancelCauseFunc
+	timers map[string]*time.Timer
+	done   map[string]bool
+}
+
+// start starts timing a phase, unless it is already timed or over
+func (p *phaseTimer) start(phase string, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timers[phase] != nil || p.done[phase] {
+		return
+	}
+	p.timers[phase] = time.AfterFunc(timeout, func() {
+		p.cancel(fmt.Errorf("%w: %s took longer than %s", errUpstreamTimeout, phase, timeout))
+	})
+}
+
+// stop ends the given phases
+func (p *phaseTimer) stop(phases ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, phase := range phases {
+		if timer := p.timers[phase]; timer != nil {
+			timer.Stop()
+		}
+		p.done[phase] = true
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/metrics"
+	"ai-api-gateway/internal/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pingFrame is an unmasked WebSocket ping frame with an empty payload
+var pingFrame = []byte{0x89, 0x00}
+
+// isWebSocketUpgrade reports whether a request is a WebSocket handshake
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// headerHasToken reports whether a comma-separated header contains token,
+// ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyWebSocket performs a WebSocket handshake with an upstream URL and, if
+// the upstream accepts it, splices the client and upstream connections until
+// either side closes or the session goes idle. Authentication and rate
+// limiting have already been applied to the handshake request.
+func (r *Router) proxyWebSocket(c *gin.Context, upstream *Upstream, path, rawQuery string, headers headerPolicies) {
+	upstreamURL := r.selectUpstream(upstream, r.newSelection(c, upstream))
+	if upstreamURL == "" {
+		writeNoUpstream(c, upstream)
+		return
+	}
+
+	at, err := r.roundTrip(c, upstream, upstreamURL, path, rawQuery, nil, false, false)
+	upstream.recordOutcome(upstreamURL, at.resp, err, c.Request.Context().Err() != nil)
+	defer at.release()
+	if err != nil {
+		writeUpstreamError(c, err)
+		return
+	}
+
+	// The upstream declined the upgrade; pass its response on
+	if at.resp.StatusCode != http.StatusSwitchingProtocols {
+		r.writeResponse(c, at, headers)
+		return
+	}
+
+	// The response timeout only applies to the handshake
+	if at.timeout != nil {
+		at.timeout.Stop()
+	}
+
+	upstreamConn, ok := at.resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		at.resp.Body.Close()
+		writeUpstreamError(c, errNotUpgradable)
+		return
+	}
+	defer upstreamConn.Close()
+
+	clientConn, clientBuf, err := c.Writer.Hijack()
+	if err != nil {
+		response.Error(c, http.StatusInternalServerError, "WebSocket upgrade is not supported on this connection")
+		return
+	}
+	defer clientConn.Close()
+
+	// Server read and write timeouts no longer apply to the hijacked
+	// connection; the session enforces its own idle timeout
+	clientConn.SetDeadline(time.Time{})
+
+	// Complete the handshake with the client
+	r.rewriteResponseHeaders(c, at.resp.Header, headers)
+	clientBuf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	at.resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	metrics.WebSocketSessions.WithLabelValues(upstream.Name).Inc()
+	metrics.WebSocketSessionsActive.WithLabelValues(upstream.Name).Inc()
+	defer metrics.WebSocketSessionsActive.WithLabelValues(upstream.Name).Dec()
+
+	session := &webSocketSession{
+		client:         clientConn,
+		clientReader:   clientBuf.Reader,
+		upstream:       upstreamConn,
+		upstreamReader: bufio.NewReader(upstreamConn),
+		cfg:            r.config.WebSocket,
+	}
+	session.run()
+}
+
+// errNotUpgradable is returned when an upstream switched protocols but its
+// connection cannot be written to
+var errNotUpgradable = errors.New("upstream connection cannot be upgraded")
+
+// webSocketSession splices a client and an upstream WebSocket connection.
+// Frames are relayed whole so that pings to the client can be sent between
+// them and only data frames count as activity.
+type webSocketSession struct {
+	client         net.Conn
+	clientReader   *bufio.Reader
+	upstream       io.ReadWriteCloser
+	upstreamReader *bufio.Reader
+	cfg            config.WebSocketConfig
+
+	writeMu      sync.Mutex // serializes writes to the client
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+	done         chan struct{}
+}
+
+// run splices the connections until either side closes or no data frame has
+// been received from either side for the idle timeout. Control frames such as
+// pongs do not count, so a session kept alive only by pings still times out.
+func (s *webSocketSession) run() {
+	s.done = make(chan struct{})
+	s.touch()
+
+	go func() {
+		s.relayFrames(s.clientReader, s.upstream, nil)
+		s.close()
+	}()
+
+	go func() {
+		s.relayFrames(s.upstreamReader, s.client, &s.writeMu)
+		s.close()
+	}()
+
+	s.keepalive()
+}
+
+// keepalive pings the client and closes idle sessions until the session ends
+func (s *webSocketSession) keepalive() {
+	var ping <-chan time.Time
+	if s.cfg.PingInterval > 0 {
+		ticker := time.NewTicker(s.cfg.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	var idle <-chan time.Time
+	if s.cfg.IdleTimeout > 0 {
+		ticker := time.NewTicker(s.cfg.IdleTimeout / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	for {
+		select {
+		case <-ping:
+			s.writeMu.Lock()
+			s.client.SetWriteDeadline(time.Now().Add(s.cfg.PingInterval))
+			_, err := s.client.Write(pingFrame)
+			s.client.SetWriteDeadline(time.Time{})
+			s.writeMu.Unlock()
+			if err != nil {
+				s.close()
+			}
+		case <-idle:
+			if time.Since(time.Unix(0, s.lastActivity.Load())) >= s.cfg.IdleTimeout {
+				s.close()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// relayFrames copies frames from src to dst, one whole frame at a time,
+// holding mu if set while a frame is written. Data frames are recorded as
+// session activity.
+func (s *webSocketSession) relayFrames(src io.Reader, dst io.Writer, mu *sync.Mutex) error {
+	header := make([]byte, 14)
+
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+
+		size := 2
+		switch header[1] & 0x7f {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if header[1]&0x80 != 0 {
+			size += 4 // masking key
+		}
+		if _, err := io.ReadFull(src, header[2:size]); err != nil {
+			return err
+		}
+
+		// Opcodes with the high bit set are control frames
+		data := header[0]&0x08 == 0
+		if data {
+			s.touch()
+		}
+
+		if mu != nil {
+			mu.Lock()
+		}
+		_, err := dst.Write(header[:size])
+		if err == nil {
+			_, err = io.CopyN(dst, src, payloadLength(header))
+		}
+		if mu != nil {
+			mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		if data {
+			s.touch()
+		}
+	}
+}
+
+// payloadLength decodes the payload length of a WebSocket frame header
+func payloadLength(header []byte) int64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return int64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return int64(binary.BigEndian.Uint64(header[2:10]) & (1<<63 - 1))
+	default:
+		return int64(length)
+	}
+}
+
+// touch records activity on the session
+func (s *webSocketSession) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// close closes both connections, ending the session
+func (s *webSocketSession) close() {
+	s.closeOnce.Do(func() {
+		s.client.Close()
+		s.upstream.Close()
+		close(s.done)
+	})
+}
@@ -0,0 +1,92 @@
+package response
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gRPC status codes used when translating gateway errors
+const (
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// Error writes an error response generated by the gateway itself. gRPC
+// requests get a trailers-only gRPC response carrying the equivalent status
+// code; all other requests get the gateway's JSON error body, which carries
+// the request ID when one was assigned.
+func Error(c *gin.Context, status int, message string) {
+	if IsGRPC(c.Request) {
+		GRPCError(c, GRPCStatus(status), message)
+		return
+	}
+
+	body := gin.H{
+		"error":     http.StatusText(status),
+		"message":   message,
+		"code":      status,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if id := c.GetString("request_id"); id != "" {
+		body["request_id"] = id
+	}
+	c.JSON(status, body)
+}
+
+// GRPCError writes a trailers-only gRPC response with the given status code
+// and message
+func GRPCError(c *gin.Context, code int, message string) {
+	c.Header("Content-Type", "application/grpc")
+	c.Header("Grpc-Status", strconv.Itoa(code))
+	c.Header("Grpc-Message", encodeGRPCMessage(message))
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+}
+
+// IsGRPC reports whether a request is a gRPC call
+func IsGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus maps an HTTP status code to the gRPC status code a gRPC client
+// should see for it
+func GRPCStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return grpcUnimplemented
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusInternalServerError:
+		return grpcInternal
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value as required by the
+// gRPC over HTTP/2 protocol
+func encodeGRPCMessage(message string) string {
+	return strings.ReplaceAll(url.PathEscape(message), "+", "%2B")
+}
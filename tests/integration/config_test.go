@@ -0,0 +1,203 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ai-api-gateway/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "gateway.yaml", `
+auth:
+  type: mock
+proxy:
+  loadBalancer: weighted
+  upstreams:
+    chat:
+      urls: [http://chat-1:8000, http://chat-2:8000]
+      weight: 3
+      healthCheck:
+        path: /health
+`)
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "mock", cfg.Auth.Type)
+	assert.Equal(t, "weighted", cfg.Proxy.LoadBalancer)
+	require.Contains(t, cfg.Proxy.Upstreams, "chat")
+	chat := cfg.Proxy.Upstreams["chat"]
+	assert.Equal(t, []string{"http://chat-1:8000", "http://chat-2:8000"}, chat.URLs)
+	assert.Equal(t, 3, chat.Weight)
+	assert.Equal(t, 10*time.Second, chat.HealthCheck.Interval)
+	assert.Equal(t, 2*time.Second, chat.HealthCheck.Timeout)
+
+	// Defaults are kept for values the file does not set
+	assert.Equal(t, 8080, cfg.Server.Port)
+}
+
+func TestLoadConfigJSONWithEnvOverride(t *testing.T) {
+	path := writeConfigFile(t, "gateway.json", `{
+  "server": {"port": 9000, "readTimeout": "10s"},
+  "auth": {"type": "mock"},
+  "proxy": {"upstreams": {"embeddings": {"urls": ["https://embeddings.internal"]}}}
+}`)
+	t.Setenv("SERVER_PORT", "9100")
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 9100, cfg.Server.Port)
+	assert.Equal(t, 10*time.Second, cfg.Server.ReadTimeout)
+	assert.Contains(t, cfg.Proxy.Upstreams, "embeddings")
+}
+
+func TestLoadConfigRejectsInvalidUpstream(t *testing.T) {
+	path := writeConfigFile(t, "gateway.yaml", `
+auth:
+  type: mock
+proxy:
+  upstreams:
+    chat:
+      urls: ["chat-1:8000"]
+`)
+
+	_, err := config.Load(path)
+	assert.ErrorContains(t, err, `upstream "chat"`)
+}
+
+func TestLoadUpstreamsFromEnv(t *testing.T) {
+	path := writeConfigFile(t, "gateway.yaml", `
+auth:
+  type: mock
+proxy:
+  upstreams:
+    chat-completions:
+      urls: [http://chat-1:8000]
+      weight: 2
+`)
+	t.Setenv("UPSTREAM_CHAT_COMPLETIONS_URLS", "http://chat-2:8000, http://chat-3:8000")
+	t.Setenv("UPSTREAM_EMBEDDINGS_URLS", "http://embeddings:8000")
+	t.Setenv("UPSTREAM_EMBEDDINGS_HEALTH_PATH", "/healthz")
+	t.Setenv("UPSTREAM_EMBEDDINGS_HEALTH_INTERVAL", "30s")
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+
+	chat := cfg.Proxy.Upstreams["chat-completions"]
+	assert.Equal(t, []string{"http://chat-2:8000", "http://chat-3:8000"}, chat.URLs)
+	assert.Equal(t, 2, chat.Weight)
+
+	embeddings := cfg.Proxy.Upstreams["embeddings"]
+	assert.Equal(t, []string{"http://embeddings:8000"}, embeddings.URLs)
+	assert.Equal(t, "/healthz", embeddings.HealthCheck.Path)
+	assert.Equal(t, 30*time.Second, embeddings.HealthCheck.Interval)
+	assert.Equal(t, 2*time.Second, embeddings.HealthCheck.Timeout)
+}
+
+func TestLoadConfigWarnsAboutUnknownUpstreamEnv(t *testing.T) {
+	t.Setenv("AUTH_TYPE", "mock")
+	t.Setenv("UPSTREAM_FOO_URLS", "http://foo:8000")
+	t.Setenv("UPSTREAM_FOO_URLZ", "http://foo:8001")
+	// Defined by Kubernetes for a service named upstream-chat
+	t.Setenv("UPSTREAM_CHAT_PORT_8000_TCP_ADDR", "10.0.0.1")
+
+	cfg, err := config.Load("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://foo:8000"}, cfg.Proxy.Upstreams["foo"].URLs)
+	assert.NotContains(t, cfg.Proxy.Upstreams, "chat")
+	assert.ElementsMatch(t, []string{
+		"UPSTREAM_FOO_URLZ: unknown upstream setting, ignored",
+		"UPSTREAM_CHAT_PORT_8000_TCP_ADDR: unknown upstream setting, ignored",
+	}, cfg.Warnings)
+}
+
+func TestLoadConfigTrustedProxies(t *testing.T) {
+	t.Setenv("AUTH_TYPE", "mock")
+
+	// Forwarding headers are trusted from anyone unless proxies are listed
+	cfg, err := config.Load("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, cfg.Proxy.TrustedProxies)
+
+	path := writeConfigFile(t, "gateway.yaml", `
+proxy:
+  trustedProxies: []
+`)
+	cfg, err = config.Load(path)
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Proxy.TrustedProxies)
+
+	t.Setenv("PROXY_TRUSTED_PROXIES", "10.0.0.0/8")
+	cfg, err = config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8"}, cfg.Proxy.TrustedProxies)
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	path := writeConfigFile(t, "gateway.yaml", `
+server:
+  port: 70000
+auth:
+  type: mock
+proxy:
+  upstreams:
+    chat:
+      urls: [http://chat-1:8000]
+      wieght: 2
+`)
+	t.Setenv("PROXY_TIMEOUT", "30")
+
+	cfg, err := config.Load(path)
+	require.Error(t, err)
+	// The partially loaded configuration is returned for further checks
+	require.NotNil(t, cfg)
+	assert.Equal(t, []string{"http://chat-1:8000"}, cfg.Proxy.Upstreams["chat"].URLs)
+
+	errs := config.Errors(err)
+	require.Len(t, errs, 3)
+	assert.Contains(t, errs[0].Error(), "field wieght not found")
+	assert.Contains(t, errs[1].Error(), "PROXY_TIMEOUT")
+	assert.Contains(t, errs[2].Error(), "invalid server port")
+}
+
+func TestLoadSecretsFromFiles(t *testing.T) {
+	jwtSecretPath := writeConfigFile(t, "jwt-secret", "file-secret\n")
+	redisPasswordPath := writeConfigFile(t, "redis-password", "redis-pass")
+	path := writeConfigFile(t, "gateway.yaml", `
+auth:
+  type: jwt
+  jwtSecretFile: `+jwtSecretPath+`
+`)
+	t.Setenv("REDIS_PASSWORD_FILE", redisPasswordPath)
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "file-secret", cfg.Auth.JWTSecret.Value())
+	assert.Equal(t, "redis-pass", cfg.Redis.Password.Value())
+	assert.Equal(t, "[REDACTED]", cfg.Auth.JWTSecret.String())
+}
+
+func TestLoadSecretRejectsValueAndFile(t *testing.T) {
+	secretPath := writeConfigFile(t, "jwt-secret", "file-secret")
+	t.Setenv("AUTH_TYPE", "jwt")
+	t.Setenv("JWT_SECRET", "env-secret")
+	t.Setenv("JWT_SECRET_FILE", secretPath)
+
+	_, err := config.Load("")
+	assert.ErrorContains(t, err, "JWT_SECRET and JWT_SECRET_FILE are mutually exclusive")
+}
@@ -0,0 +1,1626 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ai-api-gateway/internal/api"
+	"ai-api-gateway/internal/auth"
+	"ai-api-gateway/internal/cache"
+	"ai-api-gateway/internal/config"
+	"ai-api-gateway/internal/middleware"
+	"ai-api-gateway/internal/proxy"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newEchoBackend starts an upstream that reports the request it received
+func newEchoBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.Header().Set("X-Backend-Path", r.URL.Path)
+		w.Header().Set("X-Backend-Query", r.URL.RawQuery)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// newRouteTableEngine builds a gin engine serving the given proxy config
+// through the route table
+func newRouteTableEngine(t *testing.T, cfg *config.ProxyConfig) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	if cfg.LoadBalancer == "" {
+		cfg.LoadBalancer = "round_robin"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	router, err := proxy.NewRouter(cfg, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	engine.NoRoute(router.Handle)
+	return engine
+}
+
+func doRequest(engine http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestRouteTable(t *testing.T) {
+	orders := newEchoBackend(t, "orders")
+	models := newEchoBackend(t, "models")
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"orders-svc": {URLs: []string{orders.URL}},
+			"models-svc": {URLs: []string{models.URL}},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:          "orders",
+				Match:         config.RouteMatch{PathPrefix: "/v1/orders", Methods: []string{"GET"}},
+				Upstream:      "orders-svc",
+				PrefixRewrite: "/api/legacy",
+			},
+			{
+				Name:        "models-by-host",
+				Match:       config.RouteMatch{Host: "*.models.example.com", PathPrefix: "/"},
+				Upstream:    "models-svc",
+				StripPrefix: true,
+			},
+			{
+				Name:     "model-exact",
+				Match:    config.RouteMatch{PathRegex: `^/models/[a-z0-9-]+$`},
+				Upstream: "models-svc",
+			},
+		},
+	})
+
+	w := doRequest(engine, http.MethodGet, "/v1/orders/42", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "orders", w.Header().Get("X-Backend"))
+	assert.Equal(t, "/api/legacy/42", w.Header().Get("X-Backend-Path"))
+
+	// Method does not match and no other route applies
+	w = doRequest(engine, http.MethodPost, "/v1/orders/42", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Prefix matches on segment boundaries only
+	w = doRequest(engine, http.MethodGet, "/v1/orders-archive", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	req.Host = "eu.models.example.com:8080"
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, "models", w.Header().Get("X-Backend"))
+	assert.Equal(t, "/chat", w.Header().Get("X-Backend-Path"))
+
+	w = doRequest(engine, http.MethodGet, "/models/llama-3", nil)
+	assert.Equal(t, "models", w.Header().Get("X-Backend"))
+	assert.Equal(t, "/models/llama-3", w.Header().Get("X-Backend-Path"))
+}
+
+func TestRouteTableHeaderQueryAndClaimMatching(t *testing.T) {
+	stable := newEchoBackend(t, "stable")
+	beta := newEchoBackend(t, "beta")
+
+	cfg := &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"chat":      {URLs: []string{stable.URL}},
+			"chat-beta": {URLs: []string{beta.URL}},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:     "beta-tenant-header",
+				Match:    config.RouteMatch{PathPrefix: "/chat", Headers: []config.ValueMatch{{Name: "X-Tenant", Value: "beta"}}},
+				Upstream: "chat-beta",
+			},
+			{
+				Name:     "beta-api-version",
+				Match:    config.RouteMatch{PathPrefix: "/chat", Query: []config.ValueMatch{{Name: "api-version", Regex: `^2\.`}}},
+				Upstream: "chat-beta",
+			},
+			{
+				Name:     "beta-tenant-claim",
+				Match:    config.RouteMatch{PathPrefix: "/chat", Claims: []config.ValueMatch{{Name: "org.tier", Value: "beta"}}},
+				Upstream: "chat-beta",
+			},
+			{
+				Name:     "default",
+				Match:    config.RouteMatch{PathPrefix: "/chat"},
+				Upstream: "chat",
+			},
+		},
+	}
+	engine := newRouteTableEngine(t, cfg)
+
+	w := doRequest(engine, http.MethodGet, "/chat", nil)
+	assert.Equal(t, "stable", w.Header().Get("X-Backend"))
+
+	w = doRequest(engine, http.MethodGet, "/chat", http.Header{"X-Tenant": {"beta"}})
+	assert.Equal(t, "beta", w.Header().Get("X-Backend"))
+
+	w = doRequest(engine, http.MethodGet, "/chat?api-version=2.1", nil)
+	assert.Equal(t, "beta", w.Header().Get("X-Backend"))
+
+	// Claims are read from the request context populated by the auth middleware
+	router, err := proxy.NewRouter(cfg, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	withClaims := gin.New()
+	withClaims.NoRoute(func(c *gin.Context) {
+		claims := &auth.Claims{Raw: jwt.MapClaims{"org": map[string]interface{}{"tier": "beta"}}}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auth.ClaimsContextKey, claims))
+	}, router.Handle)
+
+	w = doRequest(withClaims, http.MethodGet, "/chat", nil)
+	assert.Equal(t, "beta", w.Header().Get("X-Backend"))
+}
+
+func TestRouteTableRewrites(t *testing.T) {
+	legacy := newEchoBackend(t, "legacy")
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"legacy": {URLs: []string{legacy.URL + "/base"}},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:  "order-items",
+				Match: config.RouteMatch{PathRegex: `^/v1/orders/(?P<id>[0-9]+)/items$`},
+				RegexRewrite: config.RegexRewrite{
+					Substitution: "/api/legacy/order-items/${id}",
+				},
+				Upstream: "legacy",
+			},
+			{
+				Name:          "orders",
+				Match:         config.RouteMatch{PathPrefix: "/v1/orders"},
+				PrefixRewrite: "/api/legacy",
+				QueryRewrite: config.QueryRewrite{
+					Add:    map[string]string{"source": "gateway"},
+					Remove: []string{"debug"},
+					Rename: map[string]string{"page": "p"},
+				},
+				Upstream: "legacy",
+			},
+			{
+				Name:         "status",
+				Match:        config.RouteMatch{Path: "/v1/status"},
+				PathOverride: "/healthz",
+				Upstream:     "legacy",
+			},
+			{
+				Name:     "passthrough",
+				Match:    config.RouteMatch{PathPrefix: "/"},
+				Upstream: "legacy",
+			},
+		},
+	})
+
+	w := doRequest(engine, http.MethodGet, "/v1/orders/42/items", nil)
+	assert.Equal(t, "/base/api/legacy/order-items/42", w.Header().Get("X-Backend-Path"))
+
+	w = doRequest(engine, http.MethodGet, "/v1/orders/42?page=2&debug=1&source=client", nil)
+	assert.Equal(t, "/base/api/legacy/42", w.Header().Get("X-Backend-Path"))
+	assert.Equal(t, "p=2&source=gateway", w.Header().Get("X-Backend-Query"))
+
+	w = doRequest(engine, http.MethodGet, "/v1/status?verbose=true", nil)
+	assert.Equal(t, "/base/healthz", w.Header().Get("X-Backend-Path"))
+	assert.Equal(t, "verbose=true", w.Header().Get("X-Backend-Query"))
+
+	// Query strings without rewrites are forwarded with their original encoding
+	w = doRequest(engine, http.MethodGet, "/search?q=a%20b&z=1&a=2", nil)
+	assert.Equal(t, "/base/search", w.Header().Get("X-Backend-Path"))
+	assert.Equal(t, "q=a%20b&z=1&a=2", w.Header().Get("X-Backend-Query"))
+}
+
+func TestRouteTableDotSegments(t *testing.T) {
+	public := newEchoBackend(t, "public")
+	fallback := newEchoBackend(t, "fallback")
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"public":   {URLs: []string{public.URL}},
+			"fallback": {URLs: []string{fallback.URL}},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:        "public",
+				Match:       config.RouteMatch{PathPrefix: "/api/public"},
+				Upstream:    "public",
+				StripPrefix: true,
+			},
+			{
+				Name:     "admin",
+				Match:    config.RouteMatch{Path: "/api/admin/x"},
+				Upstream: "fallback",
+			},
+		},
+	})
+
+	// Dot segments are resolved before matching, so they cannot escape the
+	// public prefix
+	for _, target := range []string{"/api/public/../admin/x", "/api/public/%2e%2e/admin/x", "/api/public/./../admin/x"} {
+		w := doRequest(engine, http.MethodGet, target, nil)
+		assert.Equal(t, "fallback", w.Header().Get("X-Backend"), target)
+		assert.Equal(t, "/api/admin/x", w.Header().Get("X-Backend-Path"), target)
+	}
+
+	w := doRequest(engine, http.MethodGet, "/api/public/../../etc/passwd", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Paths within the prefix are cleaned and keep their trailing slash
+	w = doRequest(engine, http.MethodGet, "/api/public/docs/./v1//guide/", nil)
+	assert.Equal(t, "public", w.Header().Get("X-Backend"))
+	assert.Equal(t, "/docs/v1/guide/", w.Header().Get("X-Backend-Path"))
+}
+
+func TestProxyRetries(t *testing.T) {
+	var failures, attempts atomic.Int32
+	var lastBody atomic.Value
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		lastBody.Store(string(body))
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(flaky.Close)
+
+	newEngine := func(budget config.RetryBudgetConfig) *gin.Engine {
+		return newRouteTableEngine(t, &config.ProxyConfig{
+			Upstreams: map[string]config.UpstreamConfig{
+				"flaky": {
+					URLs:  []string{flaky.URL},
+					Retry: config.RetryConfig{MaxAttempts: 3, RetryOn: []int{http.StatusServiceUnavailable}},
+				},
+			},
+			Routes: []config.RouteConfig{
+				{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "flaky"},
+			},
+			RetryBudget:         budget,
+			MaxBufferedBodySize: 1024,
+		})
+	}
+	engine := newEngine(config.RetryBudgetConfig{Ratio: 0.2, MinRetriesPerSecond: 10})
+
+	send := func(engine http.Handler, method, body string, header http.Header) int {
+		attempts.Store(0)
+		failures.Store(1)
+		req := httptest.NewRequest(method, "/orders", strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(engine, http.MethodGet, "", nil))
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// Non-idempotent requests are sent once
+	assert.Equal(t, http.StatusServiceUnavailable, send(engine, http.MethodPost, "hello", nil))
+	assert.Equal(t, int32(1), attempts.Load())
+
+	// An Idempotency-Key makes them retryable, replaying the body
+	code := send(engine, http.MethodPost, "hello", http.Header{"Idempotency-Key": {"abc"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int32(2), attempts.Load())
+	assert.Equal(t, "hello", lastBody.Load())
+
+	// Bodies larger than the buffer are streamed and not retried
+	code = send(engine, http.MethodPut, strings.Repeat("x", 2048), nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, int32(1), attempts.Load())
+
+	// An empty retry budget disables retries
+	noBudget := newEngine(config.RetryBudgetConfig{})
+	assert.Equal(t, http.StatusServiceUnavailable, send(noBudget, http.MethodGet, "", nil))
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	healthy := newEchoBackend(t, "healthy")
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	breaker := config.CircuitBreakerConfig{
+		ConsecutiveFailures: 2,
+		OpenDuration:        time.Hour,
+		HalfOpenRequests:    1,
+	}
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"pool":      {URLs: []string{healthy.URL, dead.URL}, CircuitBreaker: breaker},
+			"dead-only": {URLs: []string{dead.URL}, CircuitBreaker: breaker},
+		},
+		Routes: []config.RouteConfig{
+			{Match: config.RouteMatch{PathPrefix: "/dead"}, Upstream: "dead-only"},
+			{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "pool"},
+		},
+	})
+
+	// Round robin alternates until the dead URL's circuit opens after two
+	// failures; from then on all traffic goes to the healthy URL
+	failures := 0
+	for i := 0; i < 4; i++ {
+		if doRequest(engine, http.MethodGet, "/chat", nil).Code == http.StatusBadGateway {
+			failures++
+		}
+	}
+	assert.Equal(t, 2, failures)
+	for i := 0; i < 5; i++ {
+		w := doRequest(engine, http.MethodGet, "/chat", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// When every circuit is open requests fail fast
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusBadGateway, doRequest(engine, http.MethodGet, "/dead", nil).Code)
+	}
+	w := doRequest(engine, http.MethodGet, "/dead", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "All upstream circuits are open")
+}
+
+func TestProxyOutlierDetection(t *testing.T) {
+	healthy := newEchoBackend(t, "healthy")
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	alsoDead := httptest.NewServer(http.NotFoundHandler())
+	alsoDead.Close()
+
+	detection := config.OutlierDetectionConfig{
+		ConsecutiveErrors:  2,
+		BaseEjectionTime:   time.Hour,
+		MaxEjectionTime:    time.Hour,
+		MaxEjectionPercent: 100,
+	}
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"pool":     {URLs: []string{healthy.URL, dead.URL}, OutlierDetection: detection},
+			"all-dead": {URLs: []string{dead.URL, alsoDead.URL}, OutlierDetection: detection},
+		},
+		Routes: []config.RouteConfig{
+			{Match: config.RouteMatch{PathPrefix: "/dead"}, Upstream: "all-dead"},
+			{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "pool"},
+		},
+	})
+
+	// The dead URL is ejected after two consecutive errors
+	for i := 0; i < 4; i++ {
+		doRequest(engine, http.MethodGet, "/chat", nil)
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, doRequest(engine, http.MethodGet, "/chat", nil).Code)
+	}
+
+	// The pool is never ejected entirely, even when every URL fails
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, http.StatusBadGateway, doRequest(engine, http.MethodGet, "/dead", nil).Code)
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	disconnected := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+
+		switch r.URL.Path {
+		case "/events":
+			// The second event is only sent once the client saw the first
+			fmt.Fprint(w, "data: 1\n\n")
+			flusher.Flush()
+			<-release
+			fmt.Fprint(w, "data: 2\n\n")
+		case "/slow":
+			// Events keep coming for longer than the proxy timeout
+			for i := 0; i < 6; i++ {
+				fmt.Fprintf(w, "data: %d\n\n", i)
+				flusher.Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		case "/stall":
+			fmt.Fprint(w, "data: 1\n\n")
+			flusher.Flush()
+			<-r.Context().Done()
+			close(cancelled)
+		case "/forever":
+			for {
+				select {
+				case <-r.Context().Done():
+					close(disconnected)
+					return
+				case <-time.After(20 * time.Millisecond):
+					fmt.Fprint(w, "data: tick\n\n")
+					flusher.Flush()
+				}
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams:         map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:            []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"}},
+		Timeout:           150 * time.Millisecond,
+		StreamIdleTimeout: 200 * time.Millisecond,
+	})
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	// Events are flushed to the client as they arrive
+	resp, err := client.Get(gateway.URL + "/events")
+	require.NoError(t, err)
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	close(release)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: 2\n\n", string(rest))
+	resp.Body.Close()
+
+	// The proxy timeout only covers the response headers of a stream
+	resp, err = client.Get(gateway.URL + "/slow")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 6, strings.Count(string(body), "data:"))
+	resp.Body.Close()
+
+	// A stream that goes idle is cancelled upstream
+	resp, err = client.Get(gateway.URL + "/stall")
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle stream was not cancelled upstream")
+	}
+
+	// A client disconnecting cancels the upstream request
+	resp, err = client.Get(gateway.URL + "/forever")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	resp.Body.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client disconnect did not cancel the upstream request")
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: test\r\n\r\n")
+		buf.Flush()
+
+		// Echo the client's text frame, whose mask is all zeros, unmasked
+		frame := make([]byte, 11)
+		if _, err := io.ReadFull(buf, frame); err != nil {
+			return
+		}
+		conn.Write(append([]byte{0x81, 0x05}, frame[6:]...))
+		io.Copy(io.Discard, conn)
+	}))
+	t.Cleanup(backend.Close)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{"feed": {URLs: []string{backend.URL}}},
+		Routes:    []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "feed"}},
+		WebSocket: config.WebSocketConfig{PingInterval: 50 * time.Millisecond, IdleTimeout: 400 * time.Millisecond},
+	})
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gateway.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /status HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "test", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	_, err = conn.Write([]byte{0x81, 0x85, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'})
+	require.NoError(t, err)
+
+	// The echoed frame arrives whole, with pings from the gateway around it.
+	// Pongs answering the pings do not count as traffic, so the session is
+	// still closed as idle.
+	var frames [][]byte
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		payload := make([]byte, header[1])
+		_, err := io.ReadFull(reader, payload)
+		require.NoError(t, err)
+		frames = append(frames, append(header, payload...))
+		if header[0] == 0x89 {
+			_, err = conn.Write([]byte{0x8a, 0x80, 0, 0, 0, 0})
+			require.NoError(t, err)
+		}
+	}
+
+	assert.Contains(t, frames, []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'})
+	assert.Contains(t, frames, []byte{0x89, 0x00})
+}
+
+func TestProxyGRPC(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, r.Body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}), &http2.Server{}))
+	t.Cleanup(backend.Close)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"greeter": {URLs: []string{backend.URL}, Protocol: "h2c"},
+		},
+		Routes: []config.RouteConfig{
+			{Name: "greeter", Match: config.RouteMatch{PathPrefix: "/helloworld.Greeter"}, Upstream: "greeter"},
+		},
+	})
+	gateway := httptest.NewServer(h2c.NewHandler(engine, &http2.Server{}))
+	t.Cleanup(gateway.Close)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	call := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, gateway.URL+path, strings.NewReader("\x00\x00\x00\x00\x02hi"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Messages and trailers are relayed over HTTP/2 end to end
+	resp := call("/helloworld.Greeter/SayHello")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "\x00\x00\x00\x00\x02hi", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+
+	// Gateway errors are translated into gRPC statuses
+	resp = call("/helloworld.Unknown/SayHello")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "12", resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "No%20route%20matches%20the%20request", resp.Header.Get("Grpc-Message"))
+}
+
+func TestProxyHedging(t *testing.T) {
+	var slowCalls, slowCancelled atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowCalls.Add(1)
+		select {
+		case <-time.After(2 * time.Second):
+			w.Header().Set("X-Backend", "slow")
+		case <-r.Context().Done():
+			slowCancelled.Add(1)
+		}
+	}))
+	t.Cleanup(slow.Close)
+	fast := newEchoBackend(t, "fast")
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"replicas": {
+				URLs:  []string{fast.URL, slow.URL},
+				Hedge: config.HedgeConfig{Delay: 50 * time.Millisecond, BudgetRatio: 0.1, MinPerSecond: 1},
+			},
+		},
+		Routes: []config.RouteConfig{
+			{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "replicas"},
+		},
+		MaxBufferedBodySize: 1024,
+	})
+
+	// Round robin sends the first request to the slow URL; the hedge to the
+	// fast URL answers and the slow attempt is cancelled
+	start := time.Now()
+	w := doRequest(engine, http.MethodGet, "/v1/models", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "fast", w.Header().Get("X-Backend"))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(1), slowCalls.Load())
+	assert.Eventually(t, func() bool { return slowCancelled.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Requests that are not safe to send twice are never hedged, even if
+	// they may be retried
+	doRequest(engine, http.MethodGet, "/v1/models", nil)
+	w = doRequest(engine, http.MethodPost, "/v1/models", nil)
+	assert.Equal(t, "slow", w.Header().Get("X-Backend"))
+	w = doRequest(engine, http.MethodPut, "/v1/models", nil)
+	assert.Equal(t, "fast", w.Header().Get("X-Backend"))
+	w = doRequest(engine, http.MethodPut, "/v1/models", nil)
+	assert.Equal(t, "slow", w.Header().Get("X-Backend"))
+}
+
+func TestProxyMirroring(t *testing.T) {
+	primaryBodies := make(chan string, 10)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		primaryBodies <- string(body)
+		w.Write([]byte("primary"))
+	}))
+	t.Cleanup(primary.Close)
+
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		time.Sleep(200 * time.Millisecond)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body) + " " + r.Header.Get("X-Forwarded-For") + " " + r.Header.Get("X-Shadow")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(shadow.Close)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"model-v1": {URLs: []string{primary.URL}},
+			"model-v2": {
+				URLs:    []string{shadow.URL},
+				Headers: config.HeaderPolicy{Request: config.HeaderRules{Set: map[string]string{"X-Shadow": "${request_id}"}}},
+			},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Match:    config.RouteMatch{PathPrefix: "/v1/completions"},
+				Upstream: "model-v1",
+				Mirror:   config.MirrorPolicy{Upstream: "model-v2", Percentage: 100},
+			},
+			{
+				Match:    config.RouteMatch{PathPrefix: "/v1/embeddings"},
+				Upstream: "model-v1",
+				Mirror:   config.MirrorPolicy{Upstream: "model-v2", Percentage: 0},
+			},
+		},
+		MaxBufferedBodySize: 1024,
+		Mirror:              config.MirrorConfig{Concurrency: 1, QueueSize: 10},
+	})
+
+	// The primary response does not wait for the shadow upstream
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt":"hi"}`))
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "primary", w.Body.String())
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, `{"prompt":"hi"}`, <-primaryBodies)
+
+	select {
+	case got := <-mirrored:
+		// The copy carries the forwarding headers and the shadow upstream's
+		// header rules
+		assert.Equal(t, `POST /v1/completions {"prompt":"hi"} 192.0.2.1 req-1`, got)
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// Routes mirroring 0% of their requests send nothing to the shadow
+	req = httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader("x"))
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "x", <-primaryBodies)
+	select {
+	case got := <-mirrored:
+		t.Fatalf("unexpected mirrored request %q", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestProxyCanarySubsets(t *testing.T) {
+	stable := newEchoBackend(t, "stable")
+	canary := newEchoBackend(t, "canary")
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"chat": {
+				URLs: []string{stable.URL, canary.URL},
+				Subsets: []config.SubsetConfig{
+					{Name: "stable", URLs: []string{stable.URL}, Percentage: 100},
+					{Name: "canary", URLs: []string{canary.URL}, Percentage: 0},
+				},
+				Split: config.SplitConfig{Sticky: true, CanarySubset: "canary"},
+			},
+		},
+		Routes:       []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "chat"}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-User"))
+	})
+	adminAPI := api.NewAdminAPI(nil, nil, router, nil)
+	engine.GET("/admin/upstreams/:name/split", adminAPI.GetUpstreamSplit)
+	engine.PUT("/admin/upstreams/:name/split", adminAPI.UpdateUpstreamSplit)
+	engine.NoRoute(router.Handle)
+
+	backendFor := func(header http.Header) string {
+		return doRequest(engine, http.MethodGet, "/chat", header).Header().Get("X-Backend")
+	}
+
+	assert.Equal(t, "stable", backendFor(nil))
+	assert.Equal(t, "canary", backendFor(http.Header{"X-Canary": {"always"}}))
+
+	// Shift half of the traffic to the canary at runtime
+	update := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/upstreams/chat/split", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusBadRequest, update(`{"percentages":{"stable":50,"canary":60}}`).Code)
+	w := update(`{"percentages":{"stable":50,"canary":50}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"upstream":"chat","percentages":{"stable":50,"canary":50}}`, w.Body.String())
+
+	// Users stick to one subset, and both subsets get users
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		user := http.Header{"X-User": {fmt.Sprintf("user-%d", i)}}
+		first := backendFor(user)
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, backendFor(user))
+		}
+		seen[first] = true
+	}
+	assert.True(t, seen["stable"] && seen["canary"])
+}
+
+func TestProxyConsistentHash(t *testing.T) {
+	var healthy [3]atomic.Bool
+	upstreams := make([]string, 3)
+	for i := range upstreams {
+		i := i
+		healthy[i].Store(true)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && !healthy[i].Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("X-Backend", fmt.Sprint(i))
+		}))
+		t.Cleanup(backend.Close)
+		upstreams[i] = backend.URL
+	}
+
+	newEngine := func(hash config.ConsistentHashConfig) *gin.Engine {
+		hash.VirtualNodes = 100
+		return newRouteTableEngine(t, &config.ProxyConfig{
+			Upstreams: map[string]config.UpstreamConfig{
+				"kv": {
+					URLs:        upstreams,
+					HealthCheck: config.HealthCheckConfig{Path: "/health", Interval: 20 * time.Millisecond, Timeout: time.Second},
+				},
+			},
+			Routes:              []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "kv"}},
+			LoadBalancer:        "consistent_hash",
+			ConsistentHash:      hash,
+			MaxBufferedBodySize: 1024,
+		})
+	}
+	engine := newEngine(config.ConsistentHashConfig{Source: "header", Name: "X-Session-ID"})
+	time.Sleep(50 * time.Millisecond)
+
+	backendFor := func(session string) string {
+		return doRequest(engine, http.MethodGet, "/chat", http.Header{"X-Session-Id": {session}}).Header().Get("X-Backend")
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		before[session] = backendFor(session)
+		assert.Equal(t, before[session], backendFor(session))
+	}
+
+	// Only the sessions of a URL that fails its health check move
+	healthy[1].Store(false)
+	time.Sleep(100 * time.Millisecond)
+	moved := 0
+	for session, backend := range before {
+		after := backendFor(session)
+		if backend == "1" {
+			assert.NotEqual(t, "1", after)
+			moved++
+		} else {
+			assert.Equal(t, backend, after, session)
+		}
+	}
+	assert.Greater(t, moved, 0)
+
+	// Keys can also come from a JSON body field
+	engine = newEngine(config.ConsistentHashConfig{Source: "body_field", Name: "metadata.conversation_id"})
+	time.Sleep(50 * time.Millisecond)
+	post := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Header().Get("X-Backend")
+	}
+	first := post(`{"metadata":{"conversation_id":"c-42"},"prompt":"a"}`)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, post(fmt.Sprintf(`{"metadata":{"conversation_id":"c-42"},"prompt":"%d"}`, i)))
+	}
+}
+
+func TestProxyP2CEWMA(t *testing.T) {
+	newBackend := func(name string, delay time.Duration) string {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.Header().Set("X-Backend", name)
+		}))
+		t.Cleanup(backend.Close)
+		return backend.URL
+	}
+	slow := newBackend("slow", 30*time.Millisecond)
+	fast := newBackend("fast", 0)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams:    map[string]config.UpstreamConfig{"chat": {URLs: []string{slow, fast}}},
+		Routes:       []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "chat"}},
+		LoadBalancer: "p2c_ewma",
+		Timeout:      time.Second,
+	})
+
+	// Once both URLs have been measured, traffic goes to the faster one
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		w := doRequest(engine, http.MethodGet, "/chat", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		counts[w.Header().Get("X-Backend")]++
+	}
+	assert.LessOrEqual(t, counts["slow"], 2)
+	assert.GreaterOrEqual(t, counts["fast"], 38)
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Timeout", r.Header.Get("X-Request-Timeout"))
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(backend.Close)
+
+	engine := newRouteTableEngine(t, &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"llm": {
+				URLs:     []string{backend.URL},
+				Timeouts: config.TimeoutConfig{ResponseHeader: 50 * time.Millisecond},
+			},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Match:    config.RouteMatch{PathPrefix: "/generate"},
+				Upstream: "llm",
+				Timeouts: config.TimeoutConfig{ResponseHeader: time.Second, Total: 2 * time.Second},
+			},
+			{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"},
+		},
+	})
+
+	// Lookups use the upstream's response header timeout
+	w := doRequest(engine, http.MethodGet, "/lookup", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "response header took longer than 50ms")
+
+	// Generation overrides it and propagates the remaining deadline
+	w = doRequest(engine, http.MethodGet, "/generate", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	remaining, err := strconv.ParseFloat(w.Header().Get("X-Got-Timeout"), 64)
+	require.NoError(t, err)
+	assert.InDelta(t, 2, remaining, 0.5)
+
+	// Clients can shorten the deadline but not extend it
+	w = doRequest(engine, http.MethodGet, "/generate", http.Header{"X-Request-Timeout": {"100ms"}})
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "request deadline of 100ms exceeded")
+
+	w = doRequest(engine, http.MethodGet, "/generate", http.Header{"X-Request-Timeout": {"60"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	remaining, err = strconv.ParseFloat(w.Header().Get("X-Got-Timeout"), 64)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, remaining, 2.0)
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-User", r.Header.Get("X-User"))
+		w.Header().Set("X-Got-Tenant", r.Header.Get("X-Tenant-Id"))
+		w.Header().Set("X-Got-Debug", r.Header.Get("X-Debug"))
+		w.Header().Set("X-Got-Via", strings.Join(r.Header.Values("Via"), ","))
+		w.Header().Set("Server", "uvicorn")
+		w.Header().Set("X-Powered-By", "FastAPI")
+		w.Header().Set("X-Internal-Node", "gpu-7")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := &config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"llm": {
+				URLs: []string{backend.URL},
+				Headers: config.HeaderPolicy{
+					Request: config.HeaderRules{Append: map[string]string{"Via": "gateway"}},
+				},
+			},
+		},
+		Routes: []config.RouteConfig{{
+			Match:    config.RouteMatch{PathPrefix: "/"},
+			Upstream: "llm",
+			Headers: config.HeaderPolicy{
+				Request: config.HeaderRules{
+					Set:    map[string]string{"X-User": "${claims.sub}@${client_ip}"},
+					Rename: map[string]string{"X-Org": "X-Tenant-ID"},
+					Remove: []string{"X-Debug"},
+				},
+				Response: config.HeaderRules{
+					Remove: []string{"X-Internal-Node"},
+					Set:    map[string]string{"X-Request-ID": "${request_id}"},
+				},
+			},
+		}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+		HideHeaders:  []string{"Server", "X-Powered-By"},
+	}
+	router, err := proxy.NewRouter(cfg, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	engine.NoRoute(func(c *gin.Context) {
+		claims := &auth.Claims{Raw: jwt.MapClaims{"sub": "user-1"}}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auth.ClaimsContextKey, claims))
+	}, router.Handle)
+
+	w := doRequest(engine, http.MethodGet, "/chat", http.Header{
+		"X-User":       {"spoofed"},
+		"X-Org":        {"acme"},
+		"X-Debug":      {"1"},
+		"X-Request-Id": {"req-42"},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Request rules of the upstream and the route apply before forwarding
+	assert.Equal(t, "user-1@192.0.2.1", w.Header().Get("X-Got-User"))
+	assert.Equal(t, "acme", w.Header().Get("X-Got-Tenant"))
+	assert.Empty(t, w.Header().Get("X-Got-Debug"))
+	assert.Equal(t, "gateway", w.Header().Get("X-Got-Via"))
+
+	// Response rules apply before the upstream headers are copied back
+	assert.Empty(t, w.Header().Get("Server"))
+	assert.Empty(t, w.Header().Get("X-Powered-By"))
+	assert.Empty(t, w.Header().Get("X-Internal-Node"))
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, []string{"a=1", "b=2"}, w.Header().Values("Set-Cookie"))
+}
+
+func TestProxyForwardingHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "X-Request-Id"} {
+			w.Header().Set("X-Got-"+name, r.Header.Get(name))
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	trusted := []string{"10.0.0.0/8"}
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams:      map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:         []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/chat"}, Upstream: "llm"}},
+		LoadBalancer:   "round_robin",
+		Timeout:        5 * time.Second,
+		TrustedProxies: trusted,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	require.NoError(t, engine.SetTrustedProxies(trusted))
+	engine.Use(middleware.RequestID())
+	engine.NoRoute(router.Handle)
+
+	send := func(path, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	// Forwarding headers from untrusted clients are replaced, and a request
+	// ID is generated and returned
+	w := send("/chat", "192.0.2.1:5000", http.Header{"X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=1.2.3.4"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "192.0.2.1", w.Header().Get("X-Got-X-Forwarded-For"))
+	assert.Equal(t, "http", w.Header().Get("X-Got-X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", w.Header().Get("X-Got-X-Forwarded-Host"))
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=http", w.Header().Get("X-Got-Forwarded"))
+	assert.Len(t, w.Header().Get("X-Request-ID"), 32)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), w.Header().Get("X-Got-X-Request-Id"))
+
+	// Trusted proxies extend the chain and keep the client's request ID
+	w = send("/chat", "10.1.2.3:5000", http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=203.0.113.7;proto=https"},
+		"X-Request-Id":      {"req-42"},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "203.0.113.7, 10.1.2.3", w.Header().Get("X-Got-X-Forwarded-For"))
+	assert.Equal(t, "https", w.Header().Get("X-Got-X-Forwarded-Proto"))
+	assert.Equal(t, "for=203.0.113.7;proto=https, for=10.1.2.3;host=example.com;proto=http", w.Header().Get("X-Got-Forwarded"))
+	assert.Equal(t, "req-42", w.Header().Get("X-Got-X-Request-Id"))
+	assert.Equal(t, "req-42", w.Header().Get("X-Request-ID"))
+
+	// Gateway errors carry the request ID
+	w = send("/unknown", "192.0.2.1:5000", http.Header{"X-Request-Id": {"req-43"}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "req-43", body["request_id"])
+}
+
+func TestProxyCache(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/models", "/models-archive":
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "models")
+		case "/greeting":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, "hello "+r.Header.Get("Accept-Language"))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			io.WriteString(w, "tagged")
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams:    map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:       []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	responseCache := cache.New(config.CacheConfig{
+		Enabled:     true,
+		MaxEntries:  100,
+		MaxBodySize: 1 << 20,
+		RetainStale: time.Minute,
+		Paths:       []string{"/models", "/greeting", "/etag"},
+	}, nil, config.NewLogger("error"))
+	t.Cleanup(responseCache.Close)
+
+	engine := gin.New()
+	adminAPI := api.NewAdminAPI(nil, nil, router, responseCache)
+	engine.DELETE("/admin/cache", adminAPI.PurgeCache)
+	engine.NoRoute(responseCache.Middleware(), router.Handle)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		return doRequest(engine, http.MethodGet, path, header)
+	}
+
+	// Fresh responses are served from the cache
+	w := get("/models", nil)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	w = get("/models", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "models", w.Body.String())
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Equal(t, int32(1), hits.Load())
+
+	// Requests that opt out of caching bypass it
+	assert.Equal(t, "", get("/models", http.Header{"Cache-Control": {"no-store"}}).Header().Get("X-Cache"))
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Responses are cached per value of the headers they vary on
+	assert.Equal(t, "hello en", get("/greeting", http.Header{"Accept-Language": {"en"}}).Body.String())
+	assert.Equal(t, "hello fr", get("/greeting", http.Header{"Accept-Language": {"fr"}}).Body.String())
+	w = get("/greeting", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "hello en", w.Body.String())
+	assert.Equal(t, int32(4), hits.Load())
+
+	// Expired responses are revalidated with their ETag
+	assert.Equal(t, "tagged", get("/etag", nil).Body.String())
+	w = get("/etag", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "REVALIDATED", w.Header().Get("X-Cache"))
+	assert.Equal(t, "tagged", w.Body.String())
+	assert.Equal(t, int32(6), hits.Load())
+
+	// Purged responses are fetched again
+	req := httptest.NewRequest(http.MethodDelete, "/admin/cache?prefix=/models", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"memory":1,"redis":0}`, w.Body.String())
+	assert.Equal(t, "MISS", get("/models", nil).Header().Get("X-Cache"))
+	assert.Equal(t, int32(7), hits.Load())
+
+	// Paths are matched on segment boundaries
+	assert.Equal(t, "", get("/models-archive", nil).Header().Get("X-Cache"))
+}
+
+func TestProxyCacheRouting(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	stable, canary, beta := backend("stable"), backend("canary"), backend("beta")
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{
+			"chat": {
+				URLs: []string{stable.URL, canary.URL},
+				Subsets: []config.SubsetConfig{
+					{Name: "stable", URLs: []string{stable.URL}, Percentage: 100},
+					{Name: "canary", URLs: []string{canary.URL}, Percentage: 0},
+				},
+				Split: config.SplitConfig{CanarySubset: "canary"},
+			},
+			"chat-beta": {URLs: []string{beta.URL}},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:     "beta-tenant",
+				Match:    config.RouteMatch{PathPrefix: "/models", Headers: []config.ValueMatch{{Name: "X-Tenant", Value: "beta"}}},
+				Upstream: "chat-beta",
+			},
+			{Match: config.RouteMatch{PathPrefix: "/models"}, Upstream: "chat"},
+		},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	responseCache := cache.New(config.CacheConfig{Enabled: true, MaxEntries: 100, MaxBodySize: 1 << 20}, nil, config.NewLogger("error"))
+	t.Cleanup(responseCache.Close)
+
+	engine := gin.New()
+	engine.NoRoute(router.Resolve, responseCache.Middleware(), router.Handle)
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		return doRequest(engine, http.MethodGet, "/models", header)
+	}
+
+	assert.Equal(t, "stable", get(nil).Body.String())
+
+	// Responses are cached per route and per upstream subset, so beta and
+	// canary responses are never served to stable requests
+	assert.Equal(t, "beta", get(http.Header{"X-Tenant": {"beta"}}).Body.String())
+	assert.Equal(t, "canary", get(http.Header{"X-Canary": {"always"}}).Body.String())
+
+	w := get(nil)
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "stable", w.Body.String())
+	w = get(http.Header{"X-Canary": {"always"}})
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "canary", w.Body.String())
+}
+
+func TestProxyCachePrivateResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		io.WriteString(w, "usage of "+r.Header.Get("X-User"))
+	}))
+	t.Cleanup(backend.Close)
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams:    map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:       []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	newEngine := func(keyBy ...string) *gin.Engine {
+		responseCache := cache.New(config.CacheConfig{
+			Enabled:     true,
+			MaxEntries:  100,
+			MaxBodySize: 1 << 20,
+			KeyBy:       keyBy,
+		}, nil, config.NewLogger("error"))
+		t.Cleanup(responseCache.Close)
+
+		engine := gin.New()
+		engine.Use(func(c *gin.Context) {
+			c.Set("user_id", c.GetHeader("X-User"))
+		})
+		engine.NoRoute(responseCache.Middleware(), router.Handle)
+		return engine
+	}
+	get := func(engine *gin.Engine, user string) *httptest.ResponseRecorder {
+		return doRequest(engine, http.MethodGet, "/usage", http.Header{"X-User": {user}, "X-Tenant": {"acme"}})
+	}
+
+	// A header shared by two users does not identify them, so private
+	// responses are not cached
+	assert.Error(t, (&config.CacheConfig{Enabled: true, MaxEntries: 1, MaxBodySize: 1, KeyBy: []string{"header:X-Tenant"}}).Validate())
+	engine := newEngine("header:X-Tenant")
+	assert.Equal(t, "usage of alice", get(engine, "alice").Body.String())
+	w := get(engine, "bob")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	assert.Equal(t, "usage of bob", w.Body.String())
+
+	// Keyed by user, they are cached for each user
+	engine = newEngine("header:X-Tenant", "user_id")
+	assert.Equal(t, "usage of alice", get(engine, "alice").Body.String())
+	assert.Equal(t, "usage of bob", get(engine, "bob").Body.String())
+	w = get(engine, "alice")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "usage of alice", w.Body.String())
+}
+
+func TestProxyCoalescing(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("X-User", r.Header.Get("Authorization"))
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "mod")
+			return
+		}
+		io.WriteString(w, "models")
+	}))
+	t.Cleanup(backend.Close)
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams:    map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:       []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+		Coalesce: config.CoalesceConfig{
+			Enabled:     true,
+			VaryHeaders: []string{"Authorization"},
+			MaxBodySize: 1 << 20,
+		},
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	engine.NoRoute(router.Handle)
+
+	// Five identical requests, one for another user and one for a range
+	// arrive together
+	users := []string{"alice", "alice", "alice", "alice", "alice", "bob", "alice"}
+	responses := make([]*httptest.ResponseRecorder, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		header := http.Header{"Authorization": {user}}
+		if i == len(users)-1 {
+			header.Set("Range", "bytes=0-2")
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = doRequest(engine, http.MethodGet, "/v1/models", header)
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return hits.Load() == 3 }, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Only one request per user reached the upstream, and the range request
+	// was sent on its own
+	assert.Equal(t, int32(3), hits.Load())
+	for i, w := range responses[:len(users)-1] {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "models", w.Body.String())
+		assert.Equal(t, users[i], w.Header().Get("X-User"))
+	}
+	assert.Equal(t, http.StatusPartialContent, responses[len(users)-1].Code)
+	assert.Equal(t, "mod", responses[len(users)-1].Body.String())
+}
+
+func TestProxyCoalescingWithHeaderRules(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		io.WriteString(w, "models for "+r.Header.Get("X-User-Id"))
+	}))
+	t.Cleanup(backend.Close)
+	// Unblock the backend before it is closed, even if the test fails
+	releaseAll := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(releaseAll)
+
+	// The rule removes the headers the vary headers would tell users apart by
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams: map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes: []config.RouteConfig{{
+			Match:    config.RouteMatch{PathPrefix: "/"},
+			Upstream: "llm",
+			Headers: config.HeaderPolicy{
+				Request: config.HeaderRules{
+					Remove: []string{"Authorization", "Cookie"},
+					Set:    map[string]string{"X-User-Id": "${claims.sub}"},
+				},
+			},
+		}},
+		LoadBalancer: "round_robin",
+		Timeout:      5 * time.Second,
+		Coalesce: config.CoalesceConfig{
+			Enabled:     true,
+			VaryHeaders: []string{"Authorization", "Cookie"},
+			MaxBodySize: 1 << 20,
+		},
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	engine.NoRoute(func(c *gin.Context) {
+		claims := &auth.Claims{Raw: jwt.MapClaims{"sub": c.GetHeader("X-Test-User")}}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auth.ClaimsContextKey, claims))
+	}, router.Handle)
+
+	users := []string{"alice", "alice", "bob"}
+	responses := make([]*httptest.ResponseRecorder, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		header := http.Header{"Authorization": {"Bearer " + user}, "X-Test-User": {user}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = doRequest(engine, http.MethodGet, "/v1/models", header)
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return hits.Load() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	releaseAll()
+	wg.Wait()
+
+	// Each user got their own response, and only one per user was fetched
+	assert.Equal(t, int32(2), hits.Load())
+	for i, w := range responses {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "models for "+users[i], w.Body.String())
+	}
+}
+
+func TestProxyCompression(t *testing.T) {
+	completion := `{"choices":[` + strings.Repeat(`{"text":"the quick brown fox"},`, 100) + `{}]}`
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, completion)
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{}`)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, "already compressed")
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: 1\n\n")
+			w.(http.Flusher).Flush()
+			<-release
+			fmt.Fprint(w, "data: 2\n\n")
+		case "/upload":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Got-Content-Encoding", r.Header.Get("Content-Encoding"))
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	router, err := proxy.NewRouter(&config.ProxyConfig{
+		Upstreams:         map[string]config.UpstreamConfig{"llm": {URLs: []string{backend.URL}}},
+		Routes:            []config.RouteConfig{{Match: config.RouteMatch{PathPrefix: "/"}, Upstream: "llm"}},
+		LoadBalancer:      "round_robin",
+		Timeout:           5 * time.Second,
+		StreamIdleTimeout: 5 * time.Second,
+	}, config.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(router.Close)
+
+	engine := gin.New()
+	engine.Use(middleware.Compression(config.CompressionConfig{
+		Enabled:             true,
+		Algorithms:          []string{"zstd", "br", "gzip"},
+		MinSize:             1024,
+		ContentTypes:        []string{"application/json", "text/*"},
+		DecompressRequests:  true,
+		MaxDecompressedSize: 1 << 20,
+	}))
+	engine.NoRoute(router.Handle)
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+	// The transport must not negotiate or decode encodings itself
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(path, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, gateway.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	// The preferred accepted algorithm is used
+	for acceptEncoding, encoding := range map[string]string{
+		"gzip":                "gzip",
+		"gzip, br":            "br",
+		"gzip, br, zstd":      "zstd",
+		"zstd;q=0.5, gzip":    "gzip",
+		"*, br;q=0, zstd;q=0": "gzip",
+	} {
+		resp := get("/completion", acceptEncoding)
+		require.Equal(t, encoding, resp.Header.Get("Content-Encoding"), acceptEncoding)
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		reader, err := decoders[encoding](resp.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, completion, string(body))
+	}
+
+	// Small and already encoded bodies are passed through untouched
+	resp := get("/small", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "{}", string(body))
+	resp = get("/encoded", "br")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "already compressed", string(body))
+
+	// Streamed events are compressed and flushed as they arrive
+	resp = get("/events", "gzip")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	reader, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	events := bufio.NewReader(reader)
+	line, err := events.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	close(release)
+	rest, err := io.ReadAll(events)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: 2\n\n", string(rest))
+
+	// Compressed request bodies are decompressed for the upstream
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, completion)
+	zw.Close()
+	req, err := http.NewRequest(http.MethodPost, gateway.URL+"/upload", &compressed)
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Empty(t, resp.Header.Get("X-Got-Content-Encoding"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, completion, string(body))
+}